@@ -0,0 +1,123 @@
+// Package cache 缓存，支持进程内(LRU/LFU/TTL)、redis和两级缓存
+//
+//	local, err := cache.NewMemory(cache.MemoryConfig{Policy: cache.PolicyLRU})
+//	store := cache.NewTiered(local, cache.NewRedis(client, "user"), time.Minute)
+//	users := cache.NewTyped[User](store, cache.JSON)
+//	user, err := users.GetOrLoad(ctx, "1", 10*time.Minute, func(ctx context.Context) (User, error) {
+//		return loadUser(ctx, 1)
+//	})
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// ErrNotFound key不存在或已过期
+var ErrNotFound = errors.New("cache: key not found")
+
+// LoadTimeout GetOrLoad中load的超时时间
+var LoadTimeout = 10 * time.Second
+
+// Cache 缓存后端，值为编码后的数据
+// ttl<=0表示不过期
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// Typed 按类型编解码的缓存
+type Typed[T any] struct {
+	cache Cache
+	codec Codec
+	group singleflight.Group
+}
+
+// NewTyped codec为nil时使用JSON
+func NewTyped[T any](c Cache, codec Codec) *Typed[T] {
+	if codec == nil {
+		codec = JSON
+	}
+
+	return &Typed[T]{cache: c, codec: codec}
+}
+
+func (t *Typed[T]) Get(ctx context.Context, key string) (T, error) {
+	var v T
+	data, err := t.cache.Get(ctx, key)
+	if err != nil {
+		return v, err
+	}
+
+	err = t.codec.Unmarshal(data, &v)
+	return v, err
+}
+
+func (t *Typed[T]) Set(ctx context.Context, key string, v T, ttl time.Duration) error {
+	data, err := t.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return t.cache.Set(ctx, key, data, ttl)
+}
+
+func (t *Typed[T]) Delete(ctx context.Context, keys ...string) error {
+	return t.cache.Delete(ctx, keys...)
+}
+
+// GetOrLoad 缓存未命中时调用load加载并写入缓存
+// 同一个key同时只有一个load在执行，其他调用等待并共享结果，避免缓存击穿
+// 读缓存出错（后端不可用、数据无法解码）时按未命中处理，写缓存出错时忽略
+// load使用不随调用方取消的ctx，超时时间为LoadTimeout，调用方ctx取消时直接返回，不影响其他等待的调用
+func (t *Typed[T]) GetOrLoad(ctx context.Context, key string, ttl time.Duration, load func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
+	if v, err := t.Get(ctx, key); err == nil {
+		return v, nil
+	}
+
+	ch := t.group.DoChan(key, func() (interface{}, error) {
+		loadCtx, cancel := context.WithTimeout(detachedContext{parent: ctx}, LoadTimeout)
+		defer cancel()
+
+		// 等待期间其他调用可能已经写入缓存
+		if v, err := t.Get(loadCtx, key); err == nil {
+			return v, nil
+		}
+
+		v, err := load(loadCtx)
+		if err != nil {
+			return v, err
+		}
+
+		t.Set(loadCtx, key, v, ttl)
+		return v, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case result := <-ch:
+		if result.Err != nil {
+			return zero, result.Err
+		}
+		return result.Val.(T), nil
+	}
+}
+
+// detachedContext 保留parent中的值（如链路追踪），不继承parent的取消和超时
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
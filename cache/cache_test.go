@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestMemoryPolicy(t *testing.T) {
+	ctx := context.Background()
+	value := []byte("v")
+
+	tests := []struct {
+		policy string
+		prep   func(m *Memory)
+		evict  string
+	}{
+		{PolicyLRU, func(m *Memory) { m.Get(ctx, "a") }, "b"},
+		{PolicyLFU, func(m *Memory) { m.Get(ctx, "b"); m.Get(ctx, "b"); m.Get(ctx, "a") }, "c"},
+		{PolicyTTL, func(m *Memory) {}, "c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			m, err := NewMemory(MemoryConfig{Policy: tt.policy, MaxEntries: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Set(ctx, "a", value, 0)
+			m.Set(ctx, "b", value, time.Hour)
+			m.Set(ctx, "c", value, time.Minute)
+			tt.prep(m)
+			m.Set(ctx, "d", value, 0)
+
+			if _, err := m.Get(ctx, tt.evict); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expect %s evicted, got %v", tt.evict, err)
+			}
+			if m.Len() != 3 {
+				t.Fatalf("len %d", m.Len())
+			}
+		})
+	}
+
+	m, err := NewMemory(MemoryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set(ctx, "a", value, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if _, err := m.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect expired, got %v", err)
+	}
+
+	if _, err := NewMemory(MemoryConfig{Policy: "fifo"}); err == nil {
+		t.Fatal("expect error for unsupported policy")
+	}
+}
+
+type user struct {
+	ID   int
+	Name string
+}
+
+func TestTypedTiered(t *testing.T) {
+	ctx := context.Background()
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	for _, codec := range []Codec{JSON, Gob, Msgpack} {
+		s.FlushAll()
+		local, err := NewMemory(MemoryConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		users := NewTyped[user](NewTiered(local, NewRedis(client, "user"), time.Minute), codec)
+
+		var loads int32
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				u, err := users.GetOrLoad(ctx, "1", time.Hour, func(ctx context.Context) (user, error) {
+					atomic.AddInt32(&loads, 1)
+					time.Sleep(10 * time.Millisecond)
+					return user{ID: 1, Name: "shiba"}, nil
+				})
+				if err != nil || u.Name != "shiba" {
+					t.Errorf("GetOrLoad: %v %v", u, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if loads != 1 {
+			t.Fatalf("load called %d times", loads)
+		}
+		if !s.Exists("user:1") {
+			t.Fatal("redis not filled")
+		}
+
+		// 本地缓存失效后从redis读取
+		local.Delete(ctx, "1")
+		if u, err := users.Get(ctx, "1"); err != nil || u.ID != 1 {
+			t.Fatalf("Get: %v %v", u, err)
+		}
+
+		users.Delete(ctx, "1")
+		if _, err := users.Get(ctx, "1"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expect not found, got %v", err)
+		}
+	}
+}
+
+func TestGetOrLoadCancel(t *testing.T) {
+	local, err := NewMemory(MemoryConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := NewTyped[user](local, nil)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	load := func(ctx context.Context) (user, error) {
+		close(started)
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return user{}, ctx.Err()
+		}
+		return user{ID: 1, Name: "shiba"}, nil
+	}
+
+	// 第一个调用方取消后直接返回，load继续执行，其他调用方拿到结果
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := users.GetOrLoad(ctx, "1", time.Hour, load)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan user, 1)
+	go func() {
+		u, err := users.GetOrLoad(context.Background(), "1", time.Hour, load)
+		if err != nil {
+			t.Errorf("second GetOrLoad: %v", err)
+		}
+		second <- u
+	}()
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("first GetOrLoad: %v", err)
+	}
+
+	close(release)
+	if u := <-second; u.Name != "shiba" {
+		t.Fatalf("second GetOrLoad: %v", u)
+	}
+}
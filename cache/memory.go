@@ -0,0 +1,245 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 进程内缓存的淘汰策略，缓存满时淘汰
+const (
+	PolicyLRU = "lru" // 最久未访问
+	PolicyLFU = "lfu" // 访问次数最少，次数相同时淘汰最久未访问
+	PolicyTTL = "ttl" // 最早过期，不过期的最后淘汰
+)
+
+type MemoryConfig struct {
+	Policy     string // lru lfu ttl，默认lru
+	MaxEntries int    // 最大缓存数量，默认10000
+}
+
+// Memory 进程内缓存，过期的key在访问或淘汰时删除
+type Memory struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	evictor evictor
+	seq     uint64
+}
+
+type entry struct {
+	key      string
+	value    []byte
+	expireAt time.Time // 零值表示不过期
+	freq     uint64
+	seq      uint64 // 最后访问序号
+
+	elem  *list.Element // lru
+	index int           // lfu ttl堆中的位置
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expireAt.IsZero() && !now.Before(e.expireAt)
+}
+
+// NewMemory 创建进程内缓存，Policy不支持时返回错误
+func NewMemory(cfg MemoryConfig) (*Memory, error) {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = 10000
+	}
+
+	var ev evictor
+	switch cfg.Policy {
+	case PolicyLRU, "":
+		ev = &lruEvictor{list: list.New()}
+	case PolicyLFU:
+		ev = &heapEvictor{less: func(a, b *entry) bool {
+			if a.freq != b.freq {
+				return a.freq < b.freq
+			}
+			return a.seq < b.seq
+		}}
+	case PolicyTTL:
+		ev = &heapEvictor{less: func(a, b *entry) bool {
+			if a.expireAt.IsZero() != b.expireAt.IsZero() {
+				return b.expireAt.IsZero()
+			}
+			if !a.expireAt.Equal(b.expireAt) {
+				return a.expireAt.Before(b.expireAt)
+			}
+			return a.seq < b.seq
+		}}
+	default:
+		return nil, errors.New("cache: unsupported policy:" + cfg.Policy)
+	}
+
+	return &Memory{
+		maxEntries: cfg.MaxEntries,
+		entries:    make(map[string]*entry),
+		evictor:    ev,
+	}, nil
+}
+
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if e.expired(time.Now()) {
+		m.remove(e)
+		return nil, ErrNotFound
+	}
+
+	m.seq++
+	e.seq = m.seq
+	e.freq++
+	m.evictor.access(e)
+
+	return append([]byte(nil), e.value...), nil
+}
+
+func (m *Memory) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if value == nil {
+		return errors.New("cache: value is nil")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expireAt time.Time
+	if ttl > 0 {
+		expireAt = time.Now().Add(ttl)
+	}
+
+	m.seq++
+	if e, ok := m.entries[key]; ok {
+		e.value = append([]byte(nil), value...)
+		e.expireAt = expireAt
+		e.seq = m.seq
+		e.freq++
+		m.evictor.access(e)
+		return nil
+	}
+
+	for len(m.entries) >= m.maxEntries {
+		m.remove(m.evictor.victim())
+	}
+
+	e := &entry{
+		key:      key,
+		value:    append([]byte(nil), value...),
+		expireAt: expireAt,
+		freq:     1,
+		seq:      m.seq,
+	}
+	m.entries[key] = e
+	m.evictor.add(e)
+
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		if e, ok := m.entries[key]; ok {
+			m.remove(e)
+		}
+	}
+
+	return nil
+}
+
+// Len 缓存数量，包含已过期未删除的key
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.entries)
+}
+
+func (m *Memory) remove(e *entry) {
+	delete(m.entries, e.key)
+	m.evictor.remove(e)
+}
+
+type evictor interface {
+	add(e *entry)
+	access(e *entry)
+	remove(e *entry)
+	victim() *entry
+}
+
+type lruEvictor struct {
+	list *list.List
+}
+
+func (l *lruEvictor) add(e *entry) {
+	e.elem = l.list.PushFront(e)
+}
+
+func (l *lruEvictor) access(e *entry) {
+	l.list.MoveToFront(e.elem)
+}
+
+func (l *lruEvictor) remove(e *entry) {
+	l.list.Remove(e.elem)
+}
+
+func (l *lruEvictor) victim() *entry {
+	return l.list.Back().Value.(*entry)
+}
+
+// heapEvictor 按less排序的最小堆，堆顶为淘汰对象
+type heapEvictor struct {
+	entries []*entry
+	less    func(a, b *entry) bool
+}
+
+func (h *heapEvictor) Len() int           { return len(h.entries) }
+func (h *heapEvictor) Less(i, j int) bool { return h.less(h.entries[i], h.entries[j]) }
+
+func (h *heapEvictor) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *heapEvictor) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+
+func (h *heapEvictor) Pop() interface{} {
+	n := len(h.entries)
+	e := h.entries[n-1]
+	h.entries[n-1] = nil
+	h.entries = h.entries[:n-1]
+	return e
+}
+
+func (h *heapEvictor) add(e *entry) {
+	heap.Push(h, e)
+}
+
+func (h *heapEvictor) access(e *entry) {
+	heap.Fix(h, e.index)
+}
+
+func (h *heapEvictor) remove(e *entry) {
+	heap.Remove(h, e.index)
+}
+
+func (h *heapEvictor) victim() *entry {
+	return h.entries[0]
+}
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis 使用redis作为缓存，key会加上prefix:前缀
+type Redis struct {
+	client redis.Cmdable
+	prefix string
+}
+
+// NewRedis client可以使用shiba.Redis获取配置的redis
+func NewRedis(client redis.Cmdable, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+func (r *Redis) key(key string) string {
+	if r.prefix == "" {
+		return key
+	}
+
+	return r.prefix + ":" + key
+}
+
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := r.client.Get(ctx, r.key(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+
+	return data, err
+}
+
+func (r *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return r.client.Set(ctx, r.key(key), value, ttl).Err()
+}
+
+func (r *Redis) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// 集群模式下多个key可能不在同一个slot，逐个删除
+	for _, key := range keys {
+		if err := r.client.Del(ctx, r.key(key)).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// Tiered 两级缓存，先读进程内缓存，未命中时读redis并回填
+// 其他实例修改数据时本地缓存不会失效，localTTL应设置为可以接受的不一致时间
+type Tiered struct {
+	local    Cache
+	remote   Cache
+	localTTL time.Duration
+}
+
+func NewTiered(local, remote Cache, localTTL time.Duration) *Tiered {
+	return &Tiered{local: local, remote: remote, localTTL: localTTL}
+}
+
+func (t *Tiered) Get(ctx context.Context, key string) ([]byte, error) {
+	if data, err := t.local.Get(ctx, key); err == nil {
+		return data, nil
+	}
+
+	data, err := t.remote.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	t.local.Set(ctx, key, data, t.localTTL)
+	return data, nil
+}
+
+// Set 先写redis，成功后写本地缓存，本地缓存过期时间不超过ttl
+func (t *Tiered) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := t.remote.Set(ctx, key, value, ttl); err != nil {
+		return err
+	}
+
+	localTTL := t.localTTL
+	if ttl > 0 && (localTTL <= 0 || ttl < localTTL) {
+		localTTL = ttl
+	}
+
+	return t.local.Set(ctx, key, value, localTTL)
+}
+
+func (t *Tiered) Delete(ctx context.Context, keys ...string) error {
+	t.local.Delete(ctx, keys...)
+	return t.remote.Delete(ctx, keys...)
+}
@@ -87,17 +87,7 @@ func wrapHandle(h HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		if !shiba.Config().DisableSignatureCheck {
-			if !checkSign(commonRequest) {
-				commonResponse.Success = false
-				commonResponse.Code = ErrCodeSign
-				commonResponse.Msg = "sign校验失败"
-				w.Write(utils.JsonMarshalByte(commonResponse))
-
-				return
-			}
-		}
-
+		// 签名由shiba.signature配置的MiddlewareSignature校验
 		code, msg, data := h(&commonRequest)
 		if code == ErrCodeOk {
 			commonResponse.Success = true
@@ -128,17 +118,3 @@ func parseFormJsonStr(r *http.Request) (string, error) {
 
 	return jsonStr, nil
 }
-
-const ServerAuthKey = "NiD+6Ihdkwie40HxpZmw"
-
-func checkSign(commonRequest CommonRequest) bool {
-	sign := utils.MD5(commonRequest.AuthId + commonRequest.Method + commonRequest.ReqTime +
-		utils.MD5(commonRequest.Method+commonRequest.ReqTime+ServerAuthKey))
-
-	if commonRequest.Sign == sign {
-		return true
-	}
-
-	return false
-
-}
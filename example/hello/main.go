@@ -9,7 +9,8 @@ import (
 )
 
 func main() {
-	var middlewares []shiba.Middleware
+	var middlewares []shiba.MiddlewareFunc
+	middlewares = append(middlewares, shiba.MiddlewareRequestID)
 	middlewares = append(middlewares, shiba.MiddlewareRecover(func(
 		w http.ResponseWriter, r *http.Request, err interface{},
 	) {
@@ -727,8 +727,11 @@ func (r *Request) Do() (*Response, error) {
 		r.client.client.Jar.SetCookies(req.URL, r.cookies)
 	}
 
+	span := startSpan(req)
+
 	var resp Response
 	resp.resp, err = r.client.client.Do(req)
+	finishSpan(span, resp.resp, err)
 
 	return &resp, err
 }
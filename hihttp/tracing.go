@@ -0,0 +1,50 @@
+package hihttp
+
+import (
+	"net/http"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// startSpan 请求的ctx中有span时创建子span，使用全局tracer将span注入到请求头
+// 没有span时返回nil，不创建新的trace
+func startSpan(req *http.Request) opentracing.Span {
+	parent := opentracing.SpanFromContext(req.Context())
+	if parent == nil {
+		return nil
+	}
+
+	tracer := opentracing.GlobalTracer()
+	span := tracer.StartSpan("HTTP "+req.Method, opentracing.ChildOf(parent.Context()))
+	ext.SpanKindRPCClient.Set(span)
+	ext.Component.Set(span, "hihttp")
+	ext.HTTPMethod.Set(span, req.Method)
+	// 不记录用户名密码
+	ext.HTTPUrl.Set(span, req.URL.Redacted())
+	ext.PeerHostname.Set(span, req.URL.Hostname())
+
+	if err := tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)); err != nil {
+		span.LogKV("event", "inject", "error", err.Error())
+	}
+
+	return span
+}
+
+// finishSpan 记录响应状态码，请求失败或5xx时标记错误
+func finishSpan(span opentracing.Span, resp *http.Response, err error) {
+	if span == nil {
+		return
+	}
+
+	if err != nil {
+		ext.LogError(span, err)
+	} else {
+		ext.HTTPStatusCode.Set(span, uint16(resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			ext.Error.Set(span, true)
+		}
+	}
+
+	span.Finish()
+}
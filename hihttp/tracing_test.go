@@ -0,0 +1,61 @@
+package hihttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestTracing(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	parent := tracer.StartSpan("parent")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+	if _, err := NewRequest(http.MethodGet, srv.URL).WithContext(ctx).Do(); err != nil {
+		t.Fatal(err)
+	}
+	parent.Finish()
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("spans %d", len(spans))
+	}
+
+	span := spans[0]
+	if span.ParentID != parent.Context().(mocktracer.MockSpanContext).SpanID {
+		t.Fatal("not child of parent")
+	}
+	if span.Tag(string(ext.HTTPStatusCode)) != uint16(http.StatusBadGateway) || span.Tag(string(ext.Error)) != true {
+		t.Fatalf("tags %v", span.Tags())
+	}
+
+	sc, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.(mocktracer.MockSpanContext).SpanID != span.SpanContext.SpanID {
+		t.Fatal("header not injected")
+	}
+
+	// 没有span时不创建
+	if _, err := NewRequest(http.MethodGet, srv.URL).Do(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tracer.FinishedSpans()); n != 2 {
+		t.Fatalf("spans %d", n)
+	}
+}
@@ -69,6 +69,27 @@ type Logger interface {
 
 var defaultLogger = New("", nil, Config{})
 
+// NewRotateWriter 按cfg的fileName和转储配置返回写入文件的writer
+func NewRotateWriter(cfg Config) io.WriteCloser {
+	if cfg.RotatorMode == RotateModeDaily {
+		return &dailyRotator{
+			Filename:  cfg.FileName,
+			MaxAge:    cfg.MaxAge,
+			LocalTime: !cfg.UTCTime,
+			Compress:  cfg.Compress,
+		}
+	}
+
+	return &lumberjack.Logger{
+		Filename:   cfg.FileName,
+		MaxSize:    cfg.MaxSize,
+		MaxAge:     cfg.MaxAge,
+		MaxBackups: cfg.MaxBackups,
+		LocalTime:  !cfg.UTCTime,
+		Compress:   cfg.Compress,
+	}
+}
+
 func New(name string, w io.WriteCloser, cfg Config) Logger {
 	encoderConfig := zapcore.EncoderConfig{
 		MessageKey:       "msg",
@@ -94,25 +115,7 @@ func New(name string, w io.WriteCloser, cfg Config) Logger {
 
 	var ws []io.Writer
 	if len(cfg.FileName) > 0 {
-		var rotator io.Writer = &lumberjack.Logger{
-			Filename:   cfg.FileName,
-			MaxSize:    cfg.MaxSize,
-			MaxAge:     cfg.MaxAge,
-			MaxBackups: cfg.MaxBackups,
-			LocalTime:  !cfg.UTCTime,
-			Compress:   cfg.Compress,
-		}
-
-		if cfg.RotatorMode == RotateModeDaily {
-			rotator = &dailyRotator{
-				Filename:  cfg.FileName,
-				MaxAge:    cfg.MaxAge,
-				LocalTime: !cfg.UTCTime,
-				Compress:  cfg.Compress,
-			}
-		}
-
-		ws = append(ws, rotator)
+		ws = append(ws, NewRotateWriter(cfg))
 	} else {
 		ws = append(ws, os.Stdout)
 	}
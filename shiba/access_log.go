@@ -0,0 +1,321 @@
+package shiba
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/windzhu0514/shiba/log"
+)
+
+// 访问日志格式
+const (
+	AccessLogFormatJSON     = "json"
+	AccessLogFormatCombined = "combined" // Apache combined，末尾追加耗时(毫秒)和traceId
+)
+
+// AccessLogConfig 访问日志，enable为true时自动添加
+//
+//	shiba:
+//	  accessLog:
+//	    enable: true
+//	    format: json
+//	    trustedProxies: [10.0.0.0/8]
+//	    exclude: [/metrics]
+//	    sample:
+//	      /health: 0.01
+type AccessLogConfig struct {
+	Enable         bool               `yaml:"enable"`
+	Format         string             `yaml:"format"`         // json combined，默认json
+	File           log.Config         `yaml:"file"`           // 设置fileName时写入单独的文件，否则通过日志模块输出
+	TrustedProxies []string           `yaml:"trustedProxies"` // 可信代理的IP或CIDR，来自可信代理的请求使用X-Forwarded-For、X-Real-IP获取客户端IP
+	Exclude        []string           `yaml:"exclude"`        // 不记录的路径，以*结尾时按前缀匹配
+	Sample         map[string]float64 `yaml:"sample"`         // 按路径采样，值为记录的比例，以*结尾时按前缀匹配，5xx响应总是记录
+}
+
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Latency   float64   `json:"latency"` // 毫秒
+	Bytes     int64     `json:"bytes"`
+	ClientIP  string    `json:"clientIp"`
+	User      string    `json:"user,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	TraceID   string    `json:"traceId,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+func (e *accessLogEntry) combined() string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+
+	// referer、UA为空时和Apache一样输出"-"
+	quote := func(s string) string {
+		if s == "" {
+			return `"-"`
+		}
+		return strconv.Quote(s)
+	}
+
+	return fmt.Sprintf("%s - %s [%s] %q %d %s %s %s %.3f %s",
+		e.ClientIP, orDash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+e.Path+" "+e.Proto, e.Status, bytes, quote(e.Referer), quote(e.UserAgent), e.Latency, orDash(e.TraceID))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (e *accessLogEntry) fields() []interface{} {
+	fields := []interface{}{
+		"method", e.Method, "route", e.Route, "path", e.Path, "proto", e.Proto,
+		"status", e.Status, "latency", e.Latency, "bytes", e.Bytes, "clientIp", e.ClientIP,
+	}
+
+	for _, kv := range [][2]string{
+		{"user", e.User}, {"referer", e.Referer}, {"userAgent", e.UserAgent},
+		{"traceId", e.TraceID}, {"requestId", e.RequestID},
+	} {
+		if kv[1] != "" {
+			fields = append(fields, kv[0], kv[1])
+		}
+	}
+
+	return fields
+}
+
+// accessLogIDs 访问日志中的traceId、requestId，由内层的MiddlewareTracing、MiddlewareRequestID填写
+// 不从请求头读取，避免记录客户端伪造的值
+type accessLogIDs struct {
+	traceID   string
+	requestID string
+}
+
+type accessLogIDsKey struct{}
+
+func accessLogIDsFromContext(ctx context.Context) *accessLogIDs {
+	ids, _ := ctx.Value(accessLogIDsKey{}).(*accessLogIDs)
+	return ids
+}
+
+// MiddlewareAccessLog 记录请求的方法、路由、状态码、耗时、响应大小、客户端IP、UA和traceId
+// traceId、requestId来自MiddlewareTracing、MiddlewareRequestID，未使用时为空
+// 返回的Closer关闭日志文件，停止服务时调用
+func MiddlewareAccessLog(cfg AccessLogConfig) (MiddlewareFunc, io.Closer) {
+	logger := defaultLogger.Clone("access")
+	trusted := parseTrustedProxies(cfg.TrustedProxies, logger)
+
+	var (
+		mu     sync.Mutex
+		w      io.Writer
+		closer io.Closer = closerFunc(func() error { return nil })
+	)
+	if cfg.File.FileName != "" {
+		file := log.NewRotateWriter(cfg.File)
+		w = file
+		closer = closerFunc(func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			return file.Close()
+		})
+	}
+
+	write := func(entry *accessLogEntry) {
+		if w == nil {
+			if cfg.Format == AccessLogFormatCombined {
+				logger.Info(entry.combined())
+			} else {
+				logger.With(entry.fields()...).Info("access")
+			}
+			return
+		}
+
+		var line []byte
+		if cfg.Format == AccessLogFormatCombined {
+			line = []byte(entry.combined())
+		} else {
+			line, _ = json.Marshal(entry)
+		}
+		line = append(line, '\n')
+
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := w.Write(line); err != nil {
+			logger.Errorf("write access log:%s", err.Error())
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			path := r.URL.Path
+			if matchPaths(cfg.Exclude, path) {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			// 外层已有span、requestId时直接使用
+			ids := &accessLogIDs{requestID: RequestIDFromContext(r.Context())}
+			if span := opentracing.SpanFromContext(r.Context()); span != nil {
+				ids.traceID, _ = spanContextIDs(span.Context())
+			}
+
+			start := time.Now()
+			recorder := newResponseRecorder(rw)
+			next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), accessLogIDsKey{}, ids)))
+
+			if rate, ok := sampleRate(cfg.Sample, path); ok && recorder.status < http.StatusInternalServerError && rand.Float64() >= rate {
+				return
+			}
+
+			user := ""
+			if r.URL.User != nil {
+				user = r.URL.User.Username()
+			} else if username, _, ok := r.BasicAuth(); ok {
+				user = username
+			}
+
+			write(&accessLogEntry{
+				Time:      start,
+				Method:    r.Method,
+				Route:     routeTemplate(r),
+				Path:      r.URL.RequestURI(),
+				Proto:     r.Proto,
+				Status:    recorder.status,
+				Latency:   float64(time.Since(start).Microseconds()) / 1000,
+				Bytes:     recorder.size,
+				ClientIP:  clientIP(r, trusted),
+				User:      user,
+				Referer:   r.Referer(),
+				UserAgent: r.UserAgent(),
+				TraceID:   ids.traceID,
+				RequestID: ids.requestID,
+			})
+		})
+	}, closer
+}
+
+// matchPaths path是否匹配patterns中的路径，以*结尾时按前缀匹配
+func matchPaths(patterns []string, path string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(path, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+		} else if p == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sampleRate 返回path的采样比例，优先完全匹配，其次按最长的*前缀匹配
+func sampleRate(sample map[string]float64, path string) (float64, bool) {
+	if rate, ok := sample[path]; ok {
+		return rate, true
+	}
+
+	var (
+		rate   float64
+		prefix string
+		found  bool
+	)
+	for p, r := range sample {
+		if !strings.HasSuffix(p, "*") {
+			continue
+		}
+		if p = strings.TrimSuffix(p, "*"); strings.HasPrefix(path, p) && (!found || len(p) > len(prefix)) {
+			rate, prefix, found = r, p, true
+		}
+	}
+
+	return rate, found
+}
+
+func parseTrustedProxies(proxies []string, logger log.Logger) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			logger.Warnf("invalid trusted proxy %s:%s", proxy, err.Error())
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets
+}
+
+func ipTrusted(trusted []*net.IPNet, s string) bool {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP 直连地址是可信代理时，从X-Forwarded-For右侧跳过可信代理取第一个地址，没有时使用X-Real-IP
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	if !ipTrusted(trusted, remote) {
+		return remote
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		ips := strings.Split(xff, ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(ips[i])
+			if ip == "" {
+				continue
+			}
+			if i == 0 || !ipTrusted(trusted, ip) {
+				return ip
+			}
+		}
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+
+	return remote
+}
@@ -0,0 +1,107 @@
+package shiba
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/windzhu0514/shiba/log"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"}, defaultLogger)
+
+	cases := []struct {
+		remote, xff, realIP, want string
+	}{
+		{"1.1.1.1:80", "2.2.2.2", "", "1.1.1.1"},                        // 不可信代理忽略请求头
+		{"10.0.0.1:80", "2.2.2.2, 10.0.0.2", "", "2.2.2.2"},             // 跳过可信代理
+		{"192.168.1.1:80", "3.3.3.3, 2.2.2.2, 10.0.0.2", "", "2.2.2.2"}, // 取最右侧不可信地址
+		{"10.0.0.1:80", "", "4.4.4.4", "4.4.4.4"},
+		{"10.0.0.1:80", "", "", "10.0.0.1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if c.realIP != "" {
+			r.Header.Set("X-Real-IP", c.realIP)
+		}
+		if got := clientIP(r, trusted); got != c.want {
+			t.Errorf("%+v got %s", c, got)
+		}
+	}
+}
+
+func TestMiddlewareAccessLog(t *testing.T) {
+	dir := t.TempDir()
+	for _, format := range []string{AccessLogFormatJSON, AccessLogFormatCombined} {
+		fileName := filepath.Join(dir, format+".log")
+		mw, closer := MiddlewareAccessLog(AccessLogConfig{
+			Format:  format,
+			File:    log.Config{FileName: fileName},
+			Exclude: []string{"/debug/*"},
+			Sample:  map[string]float64{"/health": 0, "/static/*": 0},
+		})
+		router := mux.NewRouter()
+		router.Use(mux.MiddlewareFunc(mw), MiddlewareRequestID)
+		useUnmatched(router, mw)
+		router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+		})
+		router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+		router.PathPrefix("/debug/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		router.PathPrefix("/static/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+		var requestID string
+		for _, path := range []string{"/users/1?a=b", "/health", "/debug/pprof", "/static/app.js", "/missing"} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("User-Agent", "test")
+			// 没有使用MiddlewareTracing时不记录客户端传入的traceId
+			req.Header.Set("X-Trace-ID", "spoofed")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if requestID == "" {
+				requestID = rec.Header().Get(RequestIDHeader)
+			}
+		}
+
+		if err := closer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		// 没有匹配到路由的请求也记录
+		if len(lines) != 2 || !strings.Contains(lines[1], "/missing") || !strings.Contains(lines[1], "404") {
+			t.Fatalf("%s lines %q", format, lines)
+		}
+
+		if format == AccessLogFormatCombined {
+			if !strings.Contains(lines[0], `"GET /users/1?a=b HTTP/1.1" 200 5 "-" "test"`) || !strings.HasSuffix(lines[0], " -") {
+				t.Fatalf("combined %s", lines[0])
+			}
+			continue
+		}
+
+		var entry accessLogEntry
+		if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Route != "/users/{id}" || entry.Status != 200 || entry.Bytes != 5 || entry.TraceID != "" ||
+			entry.RequestID == "" || entry.RequestID != requestID || entry.UserAgent != "test" {
+			t.Fatalf("entry %+v", entry)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package shiba
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 熔断器状态
+const (
+	BreakerClosed   = "closed"    // 正常放行
+	BreakerOpen     = "open"      // 直接返回ErrCircuitOpen
+	BreakerHalfOpen = "half-open" // 放行少量探测请求
+)
+
+// ErrCircuitOpen 熔断器打开时返回的错误，使用errors.Is判断
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitOpenError 熔断器打开时返回的错误
+type CircuitOpenError struct {
+	Name  string
+	State string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return e.Name + ":circuit breaker is " + e.State
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+type breakerConfig struct {
+	Enable           bool          `yaml:"enable"`
+	Window           time.Duration `yaml:"window"`           // 错误率统计窗口，默认10s
+	MinRequests      int           `yaml:"minRequests"`      // 窗口内请求数达到该值才计算错误率，默认20
+	ErrorRate        float64       `yaml:"errorRate"`        // 错误率达到该值时打开，默认0.5
+	OpenTimeout      time.Duration `yaml:"openTimeout"`      // 打开状态持续时间，之后进入半开状态，默认30s
+	HalfOpenRequests int           `yaml:"halfOpenRequests"` // 半开状态的探测请求数，全部成功后关闭，默认5
+}
+
+func (cfg breakerConfig) withDefault() breakerConfig {
+	if cfg.Window <= 0 {
+		cfg.Window = 10 * time.Second
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	if cfg.ErrorRate <= 0 {
+		cfg.ErrorRate = 0.5
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 30 * time.Second
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 5
+	}
+
+	return cfg
+}
+
+// breaker 按固定窗口统计错误率的熔断器，nil表示不熔断
+type breaker struct {
+	name          string
+	cfg           breakerConfig
+	onStateChange func(name, from, to string)
+
+	mu          sync.Mutex
+	state       string
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int    // 半开状态已放行的探测请求
+	successes   int    // 半开状态成功的探测请求
+	generation  uint64 // 状态切换时递增，done忽略切换前放行的请求
+	rejected    int64
+}
+
+func newBreaker(name string, cfg breakerConfig) *breaker {
+	if !cfg.Enable {
+		return nil
+	}
+
+	return &breaker{
+		name:        name,
+		cfg:         cfg.withDefault(),
+		state:       BreakerClosed,
+		windowStart: time.Now(),
+	}
+}
+
+// allow 请求前调用，返回nil时必须使用返回的generation调用done
+func (b *breaker) allow() (uint64, error) {
+	if b == nil {
+		return 0, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < b.cfg.OpenTimeout {
+			b.rejected++
+			return 0, &CircuitOpenError{Name: b.name, State: BreakerOpen}
+		}
+		b.setState(BreakerHalfOpen, now)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			b.rejected++
+			return 0, &CircuitOpenError{Name: b.name, State: BreakerHalfOpen}
+		}
+		b.probes++
+	default:
+		if now.Sub(b.windowStart) >= b.cfg.Window {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+	}
+
+	return b.generation, nil
+}
+
+// done 请求结束后调用，generation为allow的返回值，err为请求返回的错误
+// 放行后状态已切换的请求不计入统计，避免关闭状态放行的请求被当作半开状态的探测请求
+func (b *breaker) done(generation uint64, err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation != b.generation {
+		return
+	}
+
+	ignore := errors.Is(err, driver.ErrSkip) || errors.Is(err, context.Canceled)
+	failed := !ignore && isBreakerFailure(err)
+	now := time.Now()
+
+	switch b.state {
+	case BreakerHalfOpen:
+		switch {
+		case failed:
+			b.setState(BreakerOpen, now)
+		case ignore:
+			b.probes--
+		default:
+			b.successes++
+			if b.successes >= b.cfg.HalfOpenRequests {
+				b.setState(BreakerClosed, now)
+			}
+		}
+	case BreakerClosed:
+		if ignore {
+			return
+		}
+
+		b.requests++
+		if failed {
+			b.failures++
+		}
+
+		if b.requests >= b.cfg.MinRequests &&
+			float64(b.failures)/float64(b.requests) >= b.cfg.ErrorRate {
+			b.setState(BreakerOpen, now)
+		}
+	}
+}
+
+func (b *breaker) setState(state string, now time.Time) {
+	from := b.state
+	b.state = state
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+	b.probes = 0
+	b.successes = 0
+	b.generation++
+	if state == BreakerOpen {
+		b.openedAt = now
+	}
+
+	if b.onStateChange != nil {
+		b.onStateChange(b.name, from, state)
+	}
+}
+
+// State 当前状态，nil返回closed
+func (b *breaker) State() string {
+	if b == nil {
+		return BreakerClosed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cfg.OpenTimeout {
+		return BreakerHalfOpen
+	}
+
+	return b.state
+}
+
+func (b *breaker) Rejected() int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rejected
+}
@@ -0,0 +1,82 @@
+package shiba
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	brk := newBreaker("test", breakerConfig{
+		Enable:           true,
+		MinRequests:      4,
+		ErrorRate:        0.5,
+		OpenTimeout:      50 * time.Millisecond,
+		HalfOpenRequests: 2,
+	})
+
+	failure := errors.New("dial tcp: i/o timeout")
+
+	// 关闭状态放行，结束前熔断器已经打开
+	staleGen, _ := brk.allow()
+
+	for _, err := range []error{nil, nil, failure, failure} {
+		gen, e := brk.allow()
+		if e != nil {
+			t.Fatal(e)
+		}
+		brk.done(gen, err)
+	}
+
+	if brk.State() != BreakerOpen {
+		t.Fatalf("state = %s, want open", brk.State())
+	}
+
+	_, err := brk.allow()
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want ErrCircuitOpen", err)
+	}
+
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) || openErr.Name != "test" {
+		t.Fatalf("err = %#v, want *CircuitOpenError", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	// 半开状态只放行HalfOpenRequests个探测请求
+	gen1, err := brk.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen2, err := brk.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := brk.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("err = %v, want ErrCircuitOpen", err)
+	}
+
+	// 关闭状态放行的请求不计为探测请求
+	brk.done(staleGen, nil)
+	brk.done(staleGen, context.Canceled)
+	if brk.State() != BreakerHalfOpen {
+		t.Fatalf("state = %s, want half-open", brk.State())
+	}
+
+	brk.done(gen1, nil)
+	brk.done(gen2, nil)
+	if brk.State() != BreakerClosed {
+		t.Fatalf("state = %s, want closed", brk.State())
+	}
+
+	if brk.Rejected() != 2 {
+		t.Fatalf("rejected = %d, want 2", brk.Rejected())
+	}
+
+	var nilBreaker *breaker
+	if _, err := nilBreaker.allow(); err != nil {
+		t.Fatal("nil breaker should allow")
+	}
+}
@@ -21,14 +21,19 @@ func loadConfig(fileName string) error {
 		return err
 	}
 
-	if err := yaml.Unmarshal(data, &rawFileCfg); err != nil {
+	var rawCfg yaml.Node
+	if err := yaml.Unmarshal(data, &rawCfg); err != nil {
 		return err
 	}
 
-	err = rawFileCfg.Decode(&fileCfg)
+	cfg := make(map[string]yaml.Node)
+	err = rawCfg.Decode(&cfg)
 	if err != nil {
 		return err
 	}
 
+	rawFileCfg = rawCfg
+	fileCfg = cfg
+
 	return nil
 }
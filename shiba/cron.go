@@ -0,0 +1,549 @@
+package shiba
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/robfig/cron/v3"
+)
+
+// 定时任务
+// 配置文件cron.jobs中声明任务的执行时间，代码中通过RegisterCronJob按名称注册执行函数，
+// 修改配置后通过/config/reload生效，不需要修改代码
+// Cron()返回的cron在每个实例上都会执行，多实例部署时使用AddCronFunc添加命名任务并开启分布式模式，
+// 每次触发前在redis或数据库中获取该任务的租约，获取成功的实例执行，租约持续到下次触发前，
+// 执行任务的实例宕机后，下次触发由其他实例执行
+// 服务停止时取消正在执行的任务的ctx，最多等待stopTimeout
+//
+//	cron:
+//	  stopTimeout: 30s
+//	  distributed:
+//	    enable: true
+//	    backend: redis
+//	    redis: default
+//	  jobs:
+//	    directLogin:
+//	      spec: "*/10 * * * *"
+//	      timeout: 5m
+//	      timezone: Asia/Shanghai
+//	      jitter: 30s
+//
+//	shiba.RegisterCronJob("directLogin", func(ctx context.Context) error {
+//		return nil
+//	})
+
+var cronParser = cron.NewParser(
+	cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
+// 分布式租约后端
+const (
+	CronBackendRedis    = "redis"
+	CronBackendDatabase = "database"
+)
+
+type cronConfig struct {
+	StopTimeout time.Duration            `yaml:"stopTimeout"` // 停止时等待正在执行的任务结束的时间，默认30s
+	Distributed cronDistributedConfig    `yaml:"distributed"`
+	Jobs        map[string]cronJobConfig `yaml:"jobs"` // RegisterCronJob注册的任务，key为任务名
+}
+
+// cronDistributedConfig 每次触发只有获取到租约的实例执行，租约在下次触发前释放
+// 周期很短的任务需要实例间时钟误差小于周期的1/10
+type cronDistributedConfig struct {
+	Enable    bool   `yaml:"enable"`
+	Backend   string `yaml:"backend"`   // redis database，默认redis
+	Redis     string `yaml:"redis"`     // redis配置名，默认default
+	Database  string `yaml:"database"`  // 数据库配置名，使用主库，租约保存在shiba_cron_lease表
+	KeyPrefix string `yaml:"keyPrefix"` // 租约key前缀，默认shiba:cron:服务名:
+}
+
+type cronJobConfig struct {
+	Spec      string        `yaml:"spec"`
+	Disable   bool          `yaml:"disable"`
+	Timeout   time.Duration `yaml:"timeout"`   // 单次执行超时时间，超时后取消ctx，0不超时
+	Timezone  string        `yaml:"timezone"`  // 计算执行时间的时区，如Asia/Shanghai，默认本地时区，spec中的CRON_TZ优先
+	Jitter    time.Duration `yaml:"jitter"`    // 每次执行随机延迟[0, jitter)，避免多个实例同时请求下游
+	Immediate bool          `yaml:"immediate"` // 调度后立即执行一次，之后按spec执行
+}
+
+// schedule 按配置组合时区、随机延迟和立即执行
+func (cfg cronJobConfig) schedule() (cron.Schedule, error) {
+	schedule, err := cronParser.Parse(cfg.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		schedule = InLocation(schedule, loc)
+	}
+
+	if cfg.Jitter > 0 {
+		schedule = Jitter(schedule, cfg.Jitter)
+	}
+
+	if cfg.Immediate {
+		schedule = Immediate(schedule)
+	}
+
+	return schedule, nil
+}
+
+// cronLeaser 获取任务在一次触发中的租约，租约到期前其他实例获取失败
+type cronLeaser interface {
+	acquire(ctx context.Context, name string, ttl time.Duration) (bool, error)
+}
+
+// CronJobFunc 定时任务，ctx在超时或服务停止时取消
+type CronJobFunc func(ctx context.Context) error
+
+type cronJob struct {
+	name     string
+	spec     string
+	schedule cron.Schedule
+	timeout  time.Duration
+	config   cronJobConfig // 配置文件声明的任务的配置，用于判断配置是否变化
+	run      CronJobFunc
+	ctx      context.Context // 服务停止时取消，调度时设置
+	entryID  cron.EntryID    // 未调度时为0
+	running  int32           // 正在执行时为1，手动触发和定时触发不会同时执行
+}
+
+// Run 定时触发
+func (job *cronJob) Run() {
+	job.exec(cronTriggerSchedule)
+}
+
+// exec 执行一次任务，trigger为触发方式，任务正在执行时跳过并返回false
+func (job *cronJob) exec(trigger string) bool {
+	if !atomic.CompareAndSwapInt32(&job.running, 0, 1) {
+		defaultLogger.Clone("cron").Infof("cron %s is still running, skip %s trigger", job.name, trigger)
+		return false
+	}
+	defer atomic.StoreInt32(&job.running, 0)
+
+	observeCronRun(job.name, trigger, func() error {
+		ctx := job.ctx
+		if job.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, job.timeout)
+			defer cancel()
+		}
+
+		return job.run(ctx)
+	})
+
+	return true
+}
+
+// RegisterCronJob 注册配置文件cron.jobs中name任务的执行函数，需要在服务启动前调用
+// 执行时间、是否启用、超时时间由配置决定，重新加载配置后生效
+func RegisterCronJob(name string, fn CronJobFunc) {
+	defaultServer.registerCronJob(name, fn)
+}
+
+func (s *Server) registerCronJob(name string, fn CronJobFunc) {
+	s.cronMu.Lock()
+	defer s.cronMu.Unlock()
+
+	if s.cronHandlers == nil {
+		s.cronHandlers = make(map[string]CronJobFunc)
+	}
+
+	if _, ok := s.cronHandlers[name]; ok {
+		panic("cron job " + name + " is alreadly registered")
+	}
+
+	if _, ok := s.cronJobs[name]; ok {
+		panic("cron job " + name + " is alreadly added by AddCronFunc")
+	}
+	s.cronHandlers[name] = fn
+
+	if s.cron != nil {
+		if err := s.applyCronJobs(s.CronConfig.Jobs); err != nil {
+			defaultLogger.Clone("cron").Error(err.Error())
+		}
+	}
+}
+
+// AddCronFunc 添加命名的定时任务，开启分布式模式时每次触发只在一个实例上执行
+// 可以在服务启动前调用，任务在cron启动后开始调度
+func AddCronFunc(name, spec string, cmd func()) error {
+	return defaultServer.addCronFunc(name, spec, 0, func(ctx context.Context) error {
+		cmd()
+		return nil
+	})
+}
+
+// AddCronJob 同AddCronFunc，每次执行的ctx在timeout后或服务停止时取消，timeout为0不超时
+func AddCronJob(name, spec string, timeout time.Duration, fn CronJobFunc) error {
+	return defaultServer.addCronFunc(name, spec, timeout, fn)
+}
+
+func (s *Server) addCronFunc(name, spec string, timeout time.Duration, fn CronJobFunc) error {
+	schedule, err := cronParser.Parse(spec)
+	if err != nil {
+		return fmt.Errorf("cron %s:%w", name, err)
+	}
+
+	s.cronMu.Lock()
+	defer s.cronMu.Unlock()
+
+	if _, ok := s.cronHandlers[name]; ok {
+		return errors.New("cron job " + name + " is alreadly registered")
+	}
+
+	if _, ok := s.cronJobs[name]; ok {
+		return errors.New("cron job " + name + " is alreadly added")
+	}
+
+	s.addCronJob(&cronJob{
+		name:     name,
+		spec:     spec,
+		schedule: schedule,
+		timeout:  timeout,
+		run:      fn,
+	})
+
+	return nil
+}
+
+func (s *Server) addCronJob(job *cronJob) {
+	if s.cronJobs == nil {
+		s.cronJobs = make(map[string]*cronJob)
+	}
+
+	s.cronJobs[job.name] = job
+	if s.cron != nil {
+		s.scheduleCronJob(job)
+	}
+}
+
+func (s *Server) removeCronJob(name string) {
+	job, ok := s.cronJobs[name]
+	if !ok {
+		return
+	}
+
+	if s.cron != nil && job.entryID != 0 {
+		s.cron.Remove(job.entryID)
+	}
+	delete(s.cronJobs, name)
+}
+
+func (s *Server) scheduleCronJob(job *cronJob) {
+	var cmd cron.Job = job
+	if s.cronLeaser != nil {
+		cmd = &distributedCronJob{job: job, leaser: s.cronLeaser}
+	}
+
+	job.ctx = s.cronCtx
+	job.entryID = s.cron.Schedule(job.schedule, cmd)
+}
+
+// applyCronJobs 按配置调度已注册的任务，配置有误时不做任何修改
+// 配置未变化的任务不重新调度
+func (s *Server) applyCronJobs(jobs map[string]cronJobConfig) error {
+	logger := defaultLogger.Clone("cron")
+	for name, cfg := range jobs {
+		if _, ok := s.cronHandlers[name]; !ok && !cfg.Disable {
+			logger.Warnf("cron job %s has no registered func", name)
+		}
+	}
+
+	schedules := make(map[string]cron.Schedule)
+	for name := range s.cronHandlers {
+		cfg, ok := jobs[name]
+		if !ok || cfg.Disable {
+			continue
+		}
+
+		schedule, err := cfg.schedule()
+		if err != nil {
+			return fmt.Errorf("cron %s:%w", name, err)
+		}
+		schedules[name] = schedule
+	}
+
+	for name, fn := range s.cronHandlers {
+		schedule, enabled := schedules[name]
+		if !enabled {
+			if _, ok := s.cronJobs[name]; ok {
+				logger.Infof("cron job %s disabled", name)
+			}
+			s.removeCronJob(name)
+			continue
+		}
+
+		cfg := jobs[name]
+		if old, ok := s.cronJobs[name]; ok && old.config == cfg {
+			continue
+		}
+
+		s.removeCronJob(name)
+		s.addCronJob(&cronJob{
+			name:     name,
+			spec:     cfg.Spec,
+			schedule: schedule,
+			timeout:  cfg.Timeout,
+			config:   cfg,
+			run:      fn,
+		})
+		logger.Infof("cron job %s scheduled:%s", name, cfg.Spec)
+	}
+
+	return nil
+}
+
+// reloadCron 重新加载cron.jobs配置，分布式配置修改需要重启生效
+func (s *Server) reloadCron() error {
+	var cfg struct {
+		Cron cronConfig `yaml:"cron"`
+	}
+	if err := rawFileCfg.Decode(&cfg); err != nil {
+		return err
+	}
+
+	s.cronMu.Lock()
+	defer s.cronMu.Unlock()
+
+	if s.cron != nil {
+		if err := s.applyCronJobs(cfg.Cron.Jobs); err != nil {
+			return err
+		}
+	}
+	s.CronConfig.Jobs = cfg.Cron.Jobs
+
+	return nil
+}
+
+func (s *Server) startCron() error {
+	cfg := s.CronConfig.Distributed
+	if cfg.Enable {
+		leaser, err := newCronLeaser(cfg, s.Config.ServiceName)
+		if err != nil {
+			return fmt.Errorf("cron distributed:%w", err)
+		}
+		s.cronLeaser = leaser
+	}
+
+	cronLogger := cronLogger{logger: defaultLogger.AddCallerSkip(1)}
+	c := cron.New(
+		cron.WithLogger(cronLogger),
+		cron.WithChain(cron.SkipIfStillRunning(cronLogger), cronRecover),
+		cron.WithParser(cronParser))
+
+	s.cronMu.Lock()
+	s.cron = c
+	s.cronCtx, s.cronCancel = context.WithCancel(context.Background())
+	for _, job := range s.cronJobs {
+		s.scheduleCronJob(job)
+	}
+	err := s.applyCronJobs(s.CronConfig.Jobs)
+	s.cronMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c.Start()
+	return nil
+}
+
+// stopCron 停止调度并取消正在执行的任务的ctx，等待任务结束，最多等待stopTimeout
+func (s *Server) stopCron() {
+	s.cronMu.Lock()
+	c, cancel := s.cron, s.cronCancel
+	s.cronStopped = true
+	s.cronMu.Unlock()
+	if c == nil {
+		return
+	}
+
+	timeout := s.CronConfig.StopTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	logger := defaultLogger.Clone("cron")
+	stopped := c.Stop()
+	cancel()
+
+	manual := make(chan struct{})
+	go func() {
+		s.cronManual.Wait()
+		close(manual)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for _, done := range []<-chan struct{}{stopped.Done(), manual} {
+		select {
+		case <-done:
+		case <-timer.C:
+			logger.Warnf("cron stop timeout after %s, some jobs are still running", timeout)
+			return
+		}
+	}
+
+	logger.Info("cron stopped")
+}
+
+// distributedCronJob 获取租约成功后执行，租约持续到下次触发前
+type distributedCronJob struct {
+	job    *cronJob
+	leaser cronLeaser
+}
+
+func (j *distributedCronJob) Run() {
+	// 随机延迟不影响租约时长，否则延迟较短的实例在下次触发时可能获取不到租约
+	now := time.Now()
+	ttl := cronLeaseTTL(baseSchedule(j.job.schedule).Next(now).Sub(now))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	acquired, err := j.leaser.acquire(ctx, j.job.name, ttl)
+	cancel()
+	if err != nil {
+		// 无法确认其他实例是否执行，跳过本次触发
+		defaultLogger.Clone("cron").Errorf("cron %s acquire lease:%s", j.job.name, err.Error())
+		return
+	}
+
+	if !acquired {
+		defaultLogger.Clone("cron").Debugf("cron %s is running on other instance", j.job.name)
+		return
+	}
+
+	j.job.exec(cronTriggerSchedule)
+}
+
+// cronLeaseTTL 租约比到下次触发的时间短period/10（最多1s），避免实例间的时钟误差导致下次触发时租约还未过期
+// 周期很短的任务（如@every 500ms）租约也按比例缩短，不会跨过下次触发，但实例间时钟误差超过period/10时可能重复执行
+func cronLeaseTTL(period time.Duration) time.Duration {
+	margin := period / 10
+	if margin > time.Second {
+		margin = time.Second
+	}
+
+	// redis和数据库按毫秒保存租约
+	ttl := period - margin
+	if ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+
+	return ttl
+}
+
+func newCronLeaser(cfg cronDistributedConfig, serviceName string) (cronLeaser, error) {
+	prefix := cfg.KeyPrefix
+	if prefix == "" {
+		prefix = "shiba:cron:" + serviceName + ":"
+	}
+
+	switch cfg.Backend {
+	case CronBackendRedis, "":
+		name := cfg.Redis
+		if name == "" {
+			name = "default"
+		}
+
+		client, err := redisx.Get(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return &redisCronLeaser{client: client, prefix: prefix, holder: instanceID()}, nil
+	case CronBackendDatabase:
+		xdb, err := db.Master(cfg.Database)
+		if err != nil {
+			return nil, err
+		}
+
+		leaser := &dbCronLeaser{db: xdb, prefix: prefix, holder: instanceID()}
+		if err := leaser.createTable(); err != nil {
+			return nil, err
+		}
+
+		return leaser, nil
+	}
+
+	return nil, errors.New("unsupported backend:" + cfg.Backend)
+}
+
+// instanceID 实例标识 hostname-pid
+func instanceID() string {
+	hostname, _ := os.Hostname()
+	return hostname + "-" + strconv.Itoa(os.Getpid())
+}
+
+type redisCronLeaser struct {
+	client RedisCmdable
+	prefix string
+	holder string
+}
+
+func (l *redisCronLeaser) acquire(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	return l.client.SetNX(ctx, l.prefix+name, l.holder, ttl).Result()
+}
+
+type dbCronLeaser struct {
+	db     *sqlx.DB
+	prefix string
+	holder string
+}
+
+func (l *dbCronLeaser) createTable() error {
+	_, err := l.db.Exec(`CREATE TABLE IF NOT EXISTS shiba_cron_lease (
+	name VARCHAR(191) NOT NULL PRIMARY KEY,
+	holder VARCHAR(191) NOT NULL,
+	expires_at BIGINT NOT NULL
+)`)
+	return err
+}
+
+// acquire 更新已过期的租约，租约不存在时插入，插入冲突说明其他实例已获取
+func (l *dbCronLeaser) acquire(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	key := l.prefix + name
+	now := time.Now()
+	expiresAt := now.Add(ttl).UnixNano() / int64(time.Millisecond)
+
+	result, err := l.db.ExecContext(ctx,
+		l.db.Rebind("UPDATE shiba_cron_lease SET holder = ?, expires_at = ? WHERE name = ? AND expires_at <= ?"),
+		l.holder, expiresAt, key, now.UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return false, err
+	} else if n > 0 {
+		return true, nil
+	}
+
+	_, err = l.db.ExecContext(ctx,
+		l.db.Rebind("INSERT INTO shiba_cron_lease (name, holder, expires_at) VALUES (?, ?, ?)"), key, l.holder, expiresAt)
+	if err == nil {
+		return true, nil
+	}
+
+	var exists int
+	if qerr := l.db.GetContext(ctx, &exists, l.db.Rebind("SELECT COUNT(*) FROM shiba_cron_lease WHERE name = ?"), key); qerr != nil {
+		return false, err
+	}
+
+	if exists > 0 {
+		return false, nil
+	}
+
+	return false, err
+}
@@ -0,0 +1,301 @@
+package shiba
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+)
+
+func init() {
+	prometheus.MustRegister(cronRuns, cronFailures, cronPanics, cronDuration, cronLastSuccess)
+}
+
+// Cron()直接添加的任务没有名称，指标中使用该名称
+const cronUnnamedJob = "unnamed"
+
+// 任务触发方式
+const (
+	cronTriggerSchedule = "schedule"
+	cronTriggerManual   = "manual"
+)
+
+// cronHistorySize 每个任务保留的执行记录数
+const cronHistorySize = 20
+
+var (
+	cronRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shiba_cron_runs_total",
+		Help: "The total number of cron job runs.",
+	}, []string{"job"})
+	cronFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shiba_cron_failures_total",
+		Help: "The total number of cron job runs that returned an error or panicked.",
+	}, []string{"job"})
+	cronPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shiba_cron_panics_total",
+		Help: "The total number of cron job panics.",
+	}, []string{"job"})
+	cronDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "shiba_cron_duration_seconds",
+		Help:    "Cron job execution time.",
+		Buckets: []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 600},
+	}, []string{"job"})
+	cronLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shiba_cron_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful cron job run.",
+	}, []string{"job"})
+)
+
+// cronRun 一次执行记录
+type cronRun struct {
+	Trigger  string        `json:"trigger"` // schedule manual
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	Panic    bool          `json:"panic,omitempty"`
+}
+
+// cronHistory 每个任务最近cronHistorySize次执行记录，新的在前
+type cronHistory struct {
+	mu   sync.Mutex
+	runs map[string][]cronRun
+}
+
+var cronRunHistory = &cronHistory{runs: make(map[string][]cronRun)}
+
+func (h *cronHistory) add(name string, run cronRun) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	runs := append([]cronRun{run}, h.runs[name]...)
+	if len(runs) > cronHistorySize {
+		runs = runs[:cronHistorySize]
+	}
+	h.runs[name] = runs
+}
+
+func (h *cronHistory) get(name string) []cronRun {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]cronRun(nil), h.runs[name]...)
+}
+
+// observeCronRun 记录指标和执行记录，run为执行函数，返回错误或panic
+func observeCronRun(name, trigger string, run func() error) {
+	logger := defaultLogger.Clone("cron")
+	record := cronRun{Trigger: trigger, Start: time.Now()}
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				record.Panic = true
+				cronPanics.WithLabelValues(name).Inc()
+				logger.Errorf("cron %s panic:%v\n%s", name, r, debug.Stack())
+				err = fmt.Errorf("panic:%v", r)
+			}
+		}()
+
+		return run()
+	}()
+
+	record.Duration = time.Since(record.Start)
+	cronRuns.WithLabelValues(name).Inc()
+	cronDuration.WithLabelValues(name).Observe(record.Duration.Seconds())
+	if err != nil {
+		record.Error = err.Error()
+		cronFailures.WithLabelValues(name).Inc()
+		if !record.Panic {
+			logger.Errorf("cron %s:%s", name, err.Error())
+		}
+	} else {
+		cronLastSuccess.WithLabelValues(name).SetToCurrentTime()
+	}
+
+	cronRunHistory.add(name, record)
+}
+
+// cronRecover Cron()直接添加的任务panic时记录日志和指标，不影响其他任务
+// 命名任务在exec中记录
+func cronRecover(j cron.Job) cron.Job {
+	switch j.(type) {
+	case *cronJob, *distributedCronJob:
+		return j
+	}
+
+	return &unnamedCronJob{job: j}
+}
+
+// unnamedCronJob Cron()直接添加的任务
+type unnamedCronJob struct {
+	job cron.Job
+}
+
+func (j *unnamedCronJob) Run() {
+	j.exec(cronTriggerSchedule)
+}
+
+func (j *unnamedCronJob) exec(trigger string) {
+	observeCronRun(cronUnnamedJob, trigger, func() error {
+		j.job.Run()
+		return nil
+	})
+}
+
+// cronEntry /cron接口返回的任务
+type cronEntry struct {
+	ID      cron.EntryID  `json:"id"`
+	Name    string        `json:"name,omitempty"`
+	Spec    string        `json:"spec,omitempty"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+	Prev    time.Time     `json:"prev"`
+	Next    time.Time     `json:"next"`
+	History []cronRun     `json:"history,omitempty"`
+}
+
+func (s *Server) cronEntries() []cronEntry {
+	s.cronMu.Lock()
+	defer s.cronMu.Unlock()
+
+	if s.cron == nil {
+		return nil
+	}
+
+	jobs := make(map[cron.EntryID]*cronJob, len(s.cronJobs))
+	for _, job := range s.cronJobs {
+		jobs[job.entryID] = job
+	}
+
+	var entries []cronEntry
+	for _, e := range s.cron.Entries() {
+		entry := cronEntry{ID: e.ID, Prev: e.Prev, Next: e.Next}
+		if job, ok := jobs[e.ID]; ok {
+			entry.Name = job.name
+			entry.Spec = job.spec
+			entry.Timeout = job.timeout
+			entry.History = cronRunHistory.get(job.name)
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Next.Before(entries[j].Next)
+	})
+
+	return entries
+}
+
+var (
+	errCronJobNotFound = errors.New("cron job not found")
+	errCronJobRunning  = errors.New("cron job is still running")
+	errCronStopped     = errors.New("cron stopped")
+)
+
+// triggerCron 在当前实例上立即执行一次任务，不经过分布式租约，name为空时按id查找
+func (s *Server) triggerCron(name string, id cron.EntryID) error {
+	s.cronMu.Lock()
+	defer s.cronMu.Unlock()
+
+	if s.cron == nil {
+		return fmt.Errorf("cron not start:%w", errCronStopped)
+	}
+	// 停止后cronManual可能正在Wait，不能再Add
+	if s.cronStopped {
+		return errCronStopped
+	}
+
+	if name != "" {
+		job, ok := s.cronJobs[name]
+		if !ok {
+			return fmt.Errorf("%w:%s", errCronJobNotFound, name)
+		}
+
+		if atomic.LoadInt32(&job.running) == 1 {
+			return fmt.Errorf("%w:%s", errCronJobRunning, name)
+		}
+
+		s.cronManual.Add(1)
+		go func() {
+			defer s.cronManual.Done()
+			job.exec(cronTriggerManual)
+		}()
+		return nil
+	}
+
+	entry := s.cron.Entry(id)
+	if !entry.Valid() {
+		return fmt.Errorf("%w:%d", errCronJobNotFound, id)
+	}
+
+	// WrappedJob经过SkipIfStillRunning包装，使用原始的Job，和按名称触发一样记录为manual
+	var run func()
+	switch job := entry.Job.(type) {
+	case *cronJob:
+		run = func() { job.exec(cronTriggerManual) }
+	case *distributedCronJob:
+		run = func() { job.job.exec(cronTriggerManual) }
+	default:
+		run = func() { (&unnamedCronJob{job: job}).exec(cronTriggerManual) }
+	}
+
+	s.cronManual.Add(1)
+	go func() {
+		defer s.cronManual.Done()
+		run()
+	}()
+	return nil
+}
+
+// serveCron GET返回任务列表、下次执行时间和执行记录
+func (s *Server) serveCron(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.cronEntries())
+}
+
+// serveCronTrigger PUT/POST立即执行任务，参数name为任务名或id为任务id
+func (s *Server) serveCronTrigger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "Only PUT and POST are supported.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("name")
+	var id int
+	if name == "" {
+		var err error
+		id, err = strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			http.Error(w, "name or id is required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := s.triggerCron(name, cron.EntryID(id)); err != nil {
+		code := http.StatusNotFound
+		switch {
+		case errors.Is(err, errCronJobRunning):
+			code = http.StatusConflict
+		case errors.Is(err, errCronStopped):
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,306 @@
+package shiba
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+func TestCronLeaser(t *testing.T) {
+	servers := newTestRedis(t, "default")
+	redisClient, _ := redisx.Get("default")
+
+	xdb, err := newTestDatabase(t).Master("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbLeaser := &dbCronLeaser{db: xdb, prefix: "test:"}
+	if err := dbLeaser.createTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	backends := map[string]struct {
+		newLeaser func(holder string) cronLeaser
+		wait      func(d time.Duration)
+	}{
+		CronBackendRedis: {
+			newLeaser: func(holder string) cronLeaser {
+				return &redisCronLeaser{client: redisClient, prefix: "test:", holder: holder}
+			},
+			wait: servers["default"].FastForward,
+		},
+		CronBackendDatabase: {
+			newLeaser: func(holder string) cronLeaser {
+				return &dbCronLeaser{db: xdb, prefix: "test:", holder: holder}
+			},
+			wait: time.Sleep,
+		},
+	}
+
+	for backend, tt := range backends {
+		newLeaser := tt.newLeaser
+		t.Run(backend, func(t *testing.T) {
+			var runs int32
+			job := &cronJob{name: "sync", schedule: constantSchedule(time.Second), run: func(ctx context.Context) error {
+				atomic.AddInt32(&runs, 1)
+				return nil
+			}}
+
+			// 两个实例同时触发，只有一个执行
+			a := &distributedCronJob{job: job, leaser: newLeaser("a")}
+			b := &distributedCronJob{job: job, leaser: newLeaser("b")}
+			a.Run()
+			b.Run()
+			if runs != 1 {
+				t.Fatalf("runs %d", runs)
+			}
+
+			// 租约过期后其他实例可以获取
+			ok, err := newLeaser("b").acquire(context.Background(), "other", 50*time.Millisecond)
+			if err != nil || !ok {
+				t.Fatalf("acquire: %v %v", ok, err)
+			}
+			tt.wait(100 * time.Millisecond)
+			ok, err = newLeaser("a").acquire(context.Background(), "other", time.Second)
+			if err != nil || !ok {
+				t.Fatalf("acquire after expire: %v %v", ok, err)
+			}
+		})
+	}
+}
+
+type constantSchedule time.Duration
+
+func (s constantSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+func TestCronLeaseTTL(t *testing.T) {
+	tests := []struct {
+		period time.Duration
+		want   time.Duration
+	}{
+		{time.Hour, time.Hour - time.Second},
+		{5 * time.Second, 4500 * time.Millisecond},
+		{time.Second, 900 * time.Millisecond},
+		{500 * time.Millisecond, 450 * time.Millisecond},
+		{0, time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		if got := cronLeaseTTL(tt.period); got != tt.want {
+			t.Errorf("cronLeaseTTL(%s) = %s, want %s", tt.period, got, tt.want)
+		}
+	}
+}
+
+func TestCronJobsConfig(t *testing.T) {
+	s := &Server{cron: cron.New(cron.WithParser(cronParser)), cronCtx: context.Background()}
+	s.registerCronJob("sync", func(ctx context.Context) error { return nil })
+	s.registerCronJob("report", func(ctx context.Context) error { return nil })
+
+	if err := s.applyCronJobs(map[string]cronJobConfig{
+		"sync":   {Spec: "@every 1m"},
+		"report": {Spec: "0 0 * * *", Disable: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.cron.Entries()); n != 1 {
+		t.Fatalf("entries %d", n)
+	}
+	syncID := s.cronJobs["sync"].entryID
+
+	// 配置有误时不修改
+	if err := s.applyCronJobs(map[string]cronJobConfig{
+		"sync":   {Spec: "@every 2m"},
+		"report": {Spec: "invalid"},
+	}); err == nil {
+		t.Fatal("expect invalid spec error")
+	}
+	if s.cronJobs["sync"].spec != "@every 1m" {
+		t.Fatal("sync changed by invalid config")
+	}
+
+	var cfg yaml.Node
+	if err := yaml.Unmarshal([]byte(`
+cron:
+  jobs:
+    sync:
+      spec: "@every 1m"
+    report:
+      spec: "0 1 * * *"
+      timeout: 10m
+`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	old := rawFileCfg
+	rawFileCfg = cfg
+	defer func() { rawFileCfg = old }()
+
+	if err := s.reloadCron(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.cron.Entries()); n != 2 {
+		t.Fatalf("entries %d", n)
+	}
+	if s.cronJobs["sync"].entryID != syncID {
+		t.Fatal("unchanged job rescheduled")
+	}
+	if s.cronJobs["report"].timeout != 10*time.Minute {
+		t.Fatalf("timeout %s", s.cronJobs["report"].timeout)
+	}
+}
+
+func TestCronStats(t *testing.T) {
+	s := &Server{cron: cron.New(cron.WithParser(cronParser)), cronCtx: context.Background()}
+	done := make(chan struct{}, 1)
+	s.registerCronJob("stats", func(ctx context.Context) error {
+		defer func() { done <- struct{}{} }()
+		panic("boom")
+	})
+	if err := s.applyCronJobs(map[string]cronJobConfig{"stats": {Spec: "@every 1h"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 指标和执行记录是全局的，-count多次运行时按差值比较
+	panics := testutil.ToFloat64(cronPanics.WithLabelValues("stats"))
+	failures := testutil.ToFloat64(cronFailures.WithLabelValues("stats"))
+	cronRunHistory.mu.Lock()
+	delete(cronRunHistory.runs, "stats")
+	cronRunHistory.mu.Unlock()
+
+	req := httptest.NewRequest(http.MethodPut, "/cron/trigger?name=stats", nil)
+	rec := httptest.NewRecorder()
+	s.serveCronTrigger(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("trigger %d %s", rec.Code, rec.Body.String())
+	}
+	<-done
+
+	// 等待exec记录执行结果
+	for i := 0; i < 100 && atomic.LoadInt32(&s.cronJobs["stats"].running) == 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := testutil.ToFloat64(cronPanics.WithLabelValues("stats")) - panics; n != 1 {
+		t.Fatalf("panics %v", n)
+	}
+	if n := testutil.ToFloat64(cronFailures.WithLabelValues("stats")) - failures; n != 1 {
+		t.Fatalf("failures %v", n)
+	}
+
+	rec = httptest.NewRecorder()
+	s.serveCron(rec, httptest.NewRequest(http.MethodGet, "/cron", nil))
+	var entries []cronEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "stats" || len(entries[0].History) != 1 {
+		t.Fatalf("entries %+v", entries)
+	}
+	if run := entries[0].History[0]; !run.Panic || run.Trigger != cronTriggerManual {
+		t.Fatalf("run %+v", run)
+	}
+
+	rec = httptest.NewRecorder()
+	s.serveCronTrigger(rec, httptest.NewRequest(http.MethodPut, "/cron/trigger?name=missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("trigger missing %d", rec.Code)
+	}
+	// 按id触发没有名称的任务
+	s.cron = cron.New(cron.WithParser(cronParser), cron.WithChain(cron.SkipIfStillRunning(cron.DiscardLogger), cronRecover))
+	id, err := s.cron.AddFunc("@every 1h", func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.triggerCron("", id); err != nil {
+		t.Fatal(err)
+	}
+	s.cronManual.Wait()
+	if runs := cronRunHistory.get(cronUnnamedJob); len(runs) == 0 || runs[0].Trigger != cronTriggerManual {
+		t.Fatalf("unnamed runs %+v", runs)
+	}
+}
+
+func TestCronStop(t *testing.T) {
+	s := &Server{CronConfig: cronConfig{StopTimeout: 2 * time.Second}}
+	if err := s.startCron(); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	if err := s.addCronFunc("wait", "@every 1h", 0, func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.triggerCron("wait", 0); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	rec := httptest.NewRecorder()
+	s.serveCronTrigger(rec, httptest.NewRequest(http.MethodPut, "/cron/trigger?name=wait", nil))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("trigger running %d", rec.Code)
+	}
+
+	begin := time.Now()
+	s.stopCron()
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("job ctx not cancelled")
+	}
+	if d := time.Since(begin); d > time.Second {
+		t.Fatalf("stop took %s", d)
+	}
+
+	rec = httptest.NewRecorder()
+	s.serveCronTrigger(rec, httptest.NewRequest(http.MethodPut, "/cron/trigger?name=wait", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("trigger after stop %d", rec.Code)
+	}
+}
+
+func TestCronSchedule(t *testing.T) {
+	cfg := cronJobConfig{Spec: "0 9 * * *", Timezone: "Asia/Shanghai", Jitter: time.Minute, Immediate: true}
+	schedule, err := cfg.schedule()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if next := schedule.Next(now); !next.Equal(now) {
+		t.Fatalf("immediate next %s", next)
+	}
+
+	// 上海时间9点为UTC 1点
+	base := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		next := schedule.Next(now)
+		if next.Before(base) || !next.Before(base.Add(time.Minute)) {
+			t.Fatalf("next %s", next)
+		}
+	}
+
+	if next := baseSchedule(schedule).Next(now); !next.Equal(base) {
+		t.Fatalf("base next %s", next)
+	}
+
+	if _, err := (cronJobConfig{Spec: "@every 1m", Timezone: "Invalid/Zone"}).schedule(); err == nil {
+		t.Fatal("expect invalid timezone error")
+	}
+}
@@ -2,17 +2,18 @@
 // 数据库
 // 支持主从
 // 从未配置，默认使用主配置
+// 支持mysql、postgres、sqlite驱动，sql统一使用?占位符，postgres配置disableRebind后使用$n占位符
 package shiba
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-
-	_ "github.com/go-sql-driver/mysql"
 )
 
 func init() {
@@ -29,18 +30,81 @@ type connectConfig struct {
 	ConnMaxLifetime time.Duration `yaml:"connMaxLifetime"`
 }
 
+func (c connectConfig) maxIdleConns() int {
+	// database/sql/sql.go
+	// const defaultMaxIdleConns = 2
+	if c.MaxIdleConns == 0 {
+		return 2
+	}
+
+	return c.MaxIdleConns
+}
+
+func (c connectConfig) limits() string {
+	return fmt.Sprintf("maxOpenConns=%d maxIdleConns=%d connMaxIdleTime=%s connMaxLifetime=%s",
+		c.MaxOpenConns, c.maxIdleConns(), c.ConnMaxIdleTime, c.ConnMaxLifetime)
+}
+
+func setPoolLimits(xdb *sqlx.DB, connCfg connectConfig) {
+	xdb.SetMaxOpenConns(connCfg.MaxOpenConns)
+	xdb.SetMaxIdleConns(connCfg.maxIdleConns())
+	xdb.SetConnMaxIdleTime(connCfg.ConnMaxIdleTime)
+	xdb.SetConnMaxLifetime(connCfg.ConnMaxLifetime)
+}
+
+// 数据库启动策略
+const (
+	StartupPolicyFailFast        = "fail-fast"        // 启动时连接，失败则服务启动失败（默认）
+	StartupPolicyLazy            = "lazy"             // 启动时不连接，首次使用时连接
+	StartupPolicyBackgroundRetry = "background-retry" // 启动时连接，失败则后台按退避间隔重试，不影响服务启动
+)
+
+const (
+	retryMinInterval = time.Second
+	retryMaxInterval = time.Minute
+)
+
+// ErrDBConnecting 数据库正在后台重连
+var ErrDBConnecting = errors.New("database is connecting in background")
+
 type databaseConfig struct {
-	Disable    bool          `yaml:"disable"`
-	DriverName string        `yaml:"driverName"`
-	Master     connectConfig `yaml:"master"`
-	Slave      connectConfig `yaml:"slave"`
+	Disable       bool          `yaml:"disable"`
+	DriverName    string        `yaml:"driverName"`    // mysql postgres sqlite
+	StartupPolicy string        `yaml:"startupPolicy"` // fail-fast lazy background-retry
+	DisableRebind bool          `yaml:"disableRebind"` // 关闭postgres执行前把?占位符重写为$n，sql中使用jsonb的?、?|、?&操作符时需要关闭
+	Master        connectConfig `yaml:"master"`
+	Slave         connectConfig `yaml:"slave"`
+	// 熔断器，主从连接池各自统计
+	CircuitBreaker breakerConfig `yaml:"circuitBreaker"`
+}
+
+func (cfg databaseConfig) validate() error {
+	if _, err := normalizeDriverName(cfg.DriverName); err != nil {
+		return err
+	}
+
+	if cfg.Master.DataSourceName == "" && cfg.Slave.DataSourceName == "" {
+		return errors.New("master and slave dataSourceName is both empty")
+	}
+
+	switch cfg.StartupPolicy {
+	case "", StartupPolicyFailFast, StartupPolicyLazy, StartupPolicyBackgroundRetry:
+		return nil
+	}
+
+	return errors.New("unsupported startupPolicy:" + cfg.StartupPolicy)
 }
 
 type database struct {
 	Config    map[string]databaseConfig `yaml:"database"`
+	Shards    map[string]shardConfig    `yaml:"databaseShard"` // 分片组
 	dbsMu     sync.RWMutex
 	dbSlaves  map[string]*sqlx.DB
 	dbMasters map[string]*sqlx.DB
+	retrying  map[string]bool     // 正在后台重连的数据库
+	breakers  map[string]*breaker // key: name/role
+	cancel    context.CancelFunc
+	retryWg   sync.WaitGroup
 }
 
 func (p *database) Name() string {
@@ -48,76 +112,129 @@ func (p *database) Name() string {
 }
 
 func (p *database) Init() error {
-	db.dbMasters = make(map[string]*sqlx.DB)
-	db.dbSlaves = make(map[string]*sqlx.DB)
+	p.dbMasters = make(map[string]*sqlx.DB)
+	p.dbSlaves = make(map[string]*sqlx.DB)
+	p.retrying = make(map[string]bool)
+	p.breakers = make(map[string]*breaker)
 	return nil
 }
 
 func (db *database) Start() error {
-	if err := db.testAll(); err != nil {
+	if err := db.validateShards(); err != nil {
 		return err
 	}
 
-	return nil
-}
+	ctx, cancel := context.WithCancel(context.Background())
+	db.cancel = cancel
 
-func (db *database) testAll() error {
 	for name, cfg := range db.Config {
 		if cfg.Disable {
 			continue
 		}
 
-		if cfg.DriverName == "" {
-			return errors.New(name + " driverName is empty")
+		if err := cfg.validate(); err != nil {
+			return errors.New(name + " " + err.Error())
 		}
 
-		if cfg.Master.DataSourceName == "" && cfg.Slave.DataSourceName == "" {
-			return errors.New(name + " master and slave dataSourceName is both empty")
-		}
-
-		if cfg.Master.DataSourceName != "" {
-			xdb, err := db.new(cfg.DriverName, cfg.Master)
-			if err != nil {
-				return fmt.Errorf(name+" master:%w", err)
+		switch cfg.StartupPolicy {
+		case StartupPolicyLazy:
+		case StartupPolicyBackgroundRetry:
+			if err := db.connect(name, cfg); err != nil {
+				defaultLogger.Clone("database").Warnf("%s connect failed, retry in background:%s", name, err.Error())
+				db.retry(ctx, name, cfg)
 			}
-
-			if err = xdb.Close(); err != nil {
-				return fmt.Errorf(name+" master:%w", err)
+		default:
+			if err := db.connect(name, cfg); err != nil {
+				return err
 			}
 		}
+	}
 
-		if cfg.Slave.DataSourceName != "" {
-			xdb, err := db.new(cfg.DriverName, cfg.Slave)
-			if err != nil {
-				return fmt.Errorf(name+" slave:%w", err)
-			}
+	return nil
+}
 
-			if err = xdb.Close(); err != nil {
-				return fmt.Errorf(name+" slave:%w", err)
-			}
+// connect 建立主从连接池，已建立的跳过
+func (db *database) connect(name string, cfg databaseConfig) error {
+	if cfg.Master.DataSourceName != "" {
+		if _, err := db.open(name, roleMaster, cfg); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Slave.DataSourceName != "" {
+		if _, err := db.open(name, roleSlave, cfg); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// retry 后台重连，间隔从retryMinInterval开始翻倍，最大retryMaxInterval
+func (db *database) retry(ctx context.Context, name string, cfg databaseConfig) {
+	db.dbsMu.Lock()
+	db.retrying[name] = true
+	db.dbsMu.Unlock()
+
+	db.retryWg.Add(1)
+	go func() {
+		defer db.retryWg.Done()
+
+		logger := defaultLogger.Clone("database")
+		interval := retryMinInterval
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+
+			err := db.connect(name, cfg)
+			if err == nil {
+				db.dbsMu.Lock()
+				delete(db.retrying, name)
+				db.dbsMu.Unlock()
+
+				logger.Infof("%s connect success in background", name)
+				return
+			}
+
+			logger.Warnf("%s connect failed, retry after %s:%s", name, interval, err.Error())
+
+			interval *= 2
+			if interval > retryMaxInterval {
+				interval = retryMaxInterval
+			}
+		}
+	}()
+}
+
 func (db *database) Stop() error {
-	for name, db := range db.dbMasters {
-		if db == nil {
+	if db.cancel != nil {
+		db.cancel()
+	}
+	db.retryWg.Wait()
+
+	db.dbsMu.Lock()
+	defer db.dbsMu.Unlock()
+
+	for name, xdb := range db.dbMasters {
+		if xdb == nil {
 			continue
 		}
 
-		if err := db.Close(); err != nil {
+		if err := xdb.Close(); err != nil {
 			return fmt.Errorf(name+" master:%w", err)
 		}
 	}
 
-	for name, db := range db.dbSlaves {
-		if db == nil {
+	for name, xdb := range db.dbSlaves {
+		// 从库未配置时使用的是主库连接池，已经关闭
+		if xdb == nil || xdb == db.dbMasters[name] {
 			continue
 		}
 
-		if err := db.Close(); err != nil {
+		if err := xdb.Close(); err != nil {
 			return fmt.Errorf(name+" slave:%w", err)
 		}
 	}
@@ -126,106 +243,141 @@ func (db *database) Stop() error {
 }
 
 func (db *database) Master(name string) (*sqlx.DB, error) {
+	return db.get(name, roleMaster)
+}
+
+// Slave 从库未配置时返回主库
+func (db *database) Slave(name string) (*sqlx.DB, error) {
+	return db.get(name, roleSlave)
+}
+
+func (db *database) get(name, role string) (*sqlx.DB, error) {
 	if name == "" {
 		name = "default"
 	}
 
-	dbMaster, ok := db.dbMasters[name]
-	if ok {
-		return dbMaster, nil
-	}
+	db.dbsMu.RLock()
+	xdb, ok := db.pools(role)[name]
+	cfg, hasCfg := db.Config[name]
+	retrying := db.retrying[name]
+	db.dbsMu.RUnlock()
 
-	db.dbsMu.Lock()
-	defer db.dbsMu.Unlock()
+	// 重新加载配置时可能禁用已建立的连接池
+	if hasCfg && cfg.Disable {
+		return nil, errors.New("sql config is disable:" + name)
+	}
 
-	dbMaster, ok = db.dbMasters[name]
 	if ok {
-		return dbMaster, nil
+		return xdb, nil
 	}
 
-	cfg, ok := db.Config[name]
-	if !ok {
+	if !hasCfg {
 		return nil, errors.New("cant find sql config:" + name)
 	}
 
-	if cfg.Disable {
-		return nil, errors.New("sql config is disable:" + name)
-	}
-
-	xdb, err := db.new(cfg.DriverName, cfg.Master)
-	if err != nil {
-		return nil, fmt.Errorf(name+" master:%w", err)
+	// 后台重连期间直接返回错误，避免每个请求都等待连接超时
+	if retrying {
+		return nil, fmt.Errorf(name+" "+role+":%w", ErrDBConnecting)
 	}
 
-	db.dbMasters[name] = xdb
-
-	return xdb, nil
+	return db.open(name, role, cfg)
 }
 
-func (db *database) Slave(name string) (*sqlx.DB, error) {
-	if name == "" {
-		name = "default"
+func (db *database) pools(role string) map[string]*sqlx.DB {
+	if role == roleSlave {
+		return db.dbSlaves
 	}
 
-	dbSlave, ok := db.dbSlaves[name]
+	return db.dbMasters
+}
+
+// open 返回已建立的连接池，不存在时建立连接，连接过程中不持有锁
+func (db *database) open(name, role string, cfg databaseConfig) (*sqlx.DB, error) {
+	db.dbsMu.RLock()
+	xdb, ok := db.pools(role)[name]
+	db.dbsMu.RUnlock()
 	if ok {
-		return dbSlave, nil
+		return xdb, nil
 	}
 
-	db.dbsMu.Lock()
-	defer db.dbsMu.Unlock()
+	if role == roleSlave && cfg.Slave.DataSourceName == "" {
+		master, err := db.open(name, roleMaster, cfg)
+		if err != nil {
+			return nil, err
+		}
 
-	dbSlave, ok = db.dbSlaves[name]
-	if ok {
-		return dbSlave, nil
+		return db.store(name, role, master, nil), nil
 	}
 
-	dbMaster, ok := db.dbMasters[name]
-	if ok {
-		return dbMaster, nil
+	connCfg := cfg.Master
+	if role == roleSlave {
+		connCfg = cfg.Slave
 	}
 
-	cfg, ok := db.Config[name]
-	if !ok {
-		return nil, errors.New("cant find sql config:" + name)
+	brk := newBreaker(name+"/"+role, cfg.CircuitBreaker)
+	if brk != nil {
+		brk.onStateChange = func(name, from, to string) {
+			defaultLogger.Clone("database").Warnf("%s circuit breaker %s -> %s", name, from, to)
+		}
 	}
 
-	if cfg.Disable {
-		return nil, errors.New("sql config is disable:" + name)
+	xdb, err := db.new(cfg.DriverName, connCfg, !cfg.DisableRebind, brk)
+	if err != nil {
+		return nil, fmt.Errorf(name+" "+role+":%w", err)
 	}
 
-	xdb, err := db.new(cfg.DriverName, cfg.Slave)
-	if err != nil {
-		return nil, fmt.Errorf(name+" slave:%w", err)
+	return db.store(name, role, xdb, brk), nil
+}
+
+// store 保存连接池，并发建立时保留先保存的连接池
+func (db *database) store(name, role string, xdb *sqlx.DB, brk *breaker) *sqlx.DB {
+	db.dbsMu.Lock()
+	defer db.dbsMu.Unlock()
+
+	pools := db.pools(role)
+	if exist, ok := pools[name]; ok {
+		if exist != xdb && xdb != db.dbMasters[name] {
+			xdb.Close()
+		}
+		return exist
 	}
 
-	db.dbSlaves[name] = xdb
-	return xdb, nil
+	pools[name] = xdb
+	if brk != nil {
+		db.breakers[name+"/"+role] = brk
+	}
+
+	return xdb
 }
 
-func (db *database) new(driverName string, connCfg connectConfig) (*sqlx.DB, error) {
+func (db *database) new(driverName string, connCfg connectConfig, rebind bool, brk *breaker) (*sqlx.DB, error) {
 	if driverName == "" || connCfg.DataSourceName == "" {
 		return nil, errors.New("driverName or dataSourceName is empty")
 	}
 
-	xdb, err := sqlx.Connect(driverName, connCfg.DataSourceName)
+	driverName, err := normalizeDriverName(driverName)
 	if err != nil {
 		return nil, err
 	}
 
-	// database/sql/sql.go
-	// const defaultMaxIdleConns = 2
-	maxIdleConns := connCfg.MaxIdleConns
-	if maxIdleConns == 0 {
-		maxIdleConns = 2
+	sqlDB, err := openDB(driverName, connCfg.DataSourceName, rebind, brk)
+	if err != nil {
+		return nil, err
 	}
 
-	xdb.SetMaxOpenConns(connCfg.MaxOpenConns)
-	xdb.SetMaxIdleConns(connCfg.MaxIdleConns)
-	xdb.SetConnMaxIdleTime(connCfg.ConnMaxIdleTime)
-	xdb.SetConnMaxLifetime(connCfg.ConnMaxLifetime)
+	// sqlx根据驱动名决定占位符类型
+	xdb := sqlx.NewDb(sqlDB, driverName)
+
+	// sqlite内存数据库每个连接都是独立的库，未配置时限制为单连接
+	if driverName == DriverSQLite && connCfg.MaxOpenConns == 0 &&
+		strings.Contains(connCfg.DataSourceName, ":memory:") {
+		connCfg.MaxOpenConns = 1
+	}
+
+	setPoolLimits(xdb, connCfg)
 
 	if err = xdb.Ping(); err != nil {
+		xdb.Close()
 		return nil, err
 	}
 
@@ -0,0 +1,362 @@
+package shiba
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+)
+
+// 支持的数据库驱动
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite" // 纯go实现(modernc.org/sqlite)，不依赖cgo
+)
+
+func init() {
+	// modernc.org/sqlite注册的驱动名为sqlite，sqlx默认不识别
+	sqlx.BindDriver(DriverSQLite, sqlx.QUESTION)
+}
+
+// normalizeDriverName 统一驱动别名，返回sqlx使用的驱动名
+func normalizeDriverName(driverName string) (string, error) {
+	switch strings.ToLower(driverName) {
+	case "mysql":
+		return DriverMySQL, nil
+	case "postgres", "postgresql", "pgsql", "pq":
+		return DriverPostgres, nil
+	case "sqlite", "sqlite3":
+		return DriverSQLite, nil
+	case "":
+		return "", errors.New("driverName is empty")
+	}
+
+	return "", errors.New("unsupported driverName:" + driverName)
+}
+
+// openDB 打开连接池，连接经过wrapConn包装：
+// 默认postgres执行前把?占位符重写为$n，同一份sql可以在mysql、sqlite、postgres上执行；
+// 配置了熔断器时，建立连接和执行sql都经过熔断器
+func openDB(driverName, dataSourceName string, rebind bool, brk *breaker) (*sql.DB, error) {
+	// 借助sql.Open获取已注册的驱动
+	tmp, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	drv := tmp.Driver()
+	tmp.Close()
+
+	var connector driver.Connector
+	if dc, ok := drv.(driver.DriverContext); ok {
+		connector, err = dc.OpenConnector(dataSourceName)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		connector = dsnConnector{dsn: dataSourceName, driver: drv}
+	}
+
+	bindType := sqlx.QUESTION
+	if rebind && driverName == DriverPostgres {
+		bindType = sqlx.DOLLAR
+	}
+
+	return sql.OpenDB(&wrapConnector{connector: connector, bindType: bindType, breaker: brk}), nil
+}
+
+// isBreakerFailure 数据库返回的错误（语法错误、主键冲突等）说明数据库可用，不计入熔断
+func isBreakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var (
+		mysqlErr  *mysql.MySQLError
+		pqErr     *pq.Error
+		sqliteErr *sqlite.Error
+	)
+	if errors.As(err, &mysqlErr) || errors.As(err, &pqErr) || errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	return !errors.Is(err, driver.ErrSkip) && !errors.Is(err, context.Canceled)
+}
+
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type wrapConnector struct {
+	connector driver.Connector
+	bindType  int
+	breaker   *breaker
+}
+
+func (c *wrapConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	gen, err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := c.connector.Connect(ctx)
+	c.breaker.done(gen, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wrapConn{Conn: conn, bindType: c.bindType, breaker: c.breaker}, nil
+}
+
+func (c *wrapConnector) Driver() driver.Driver {
+	return c.connector.Driver()
+}
+
+type wrapConn struct {
+	driver.Conn
+	bindType int
+	breaker  *breaker
+}
+
+// rebind 使用sqlx.Rebind重写占位符，不识别字符串字面量和jsonb操作符中的?，sql中需要?字面量时请使用参数传入
+func (c *wrapConn) rebind(query string) string {
+	if c.bindType == sqlx.QUESTION {
+		return query
+	}
+
+	return sqlx.Rebind(c.bindType, query)
+}
+
+func (c *wrapConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *wrapConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	gen, err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	var stmt driver.Stmt
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, c.rebind(query))
+	} else {
+		stmt, err = c.Conn.Prepare(c.rebind(query))
+	}
+	c.breaker.done(gen, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wrapStmt{Stmt: stmt, conn: c.Conn, breaker: c.breaker}, nil
+}
+
+func (c *wrapConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	gen, err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.QueryContext(ctx, c.rebind(query), args)
+	c.breaker.done(gen, err)
+	return rows, err
+}
+
+func (c *wrapConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	gen, err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := e.ExecContext(ctx, c.rebind(query), args)
+	c.breaker.done(gen, err)
+	return result, err
+}
+
+func (c *wrapConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	gen, err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	var tx driver.Tx
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = b.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.Conn.Begin() // nolint:staticcheck
+	}
+	c.breaker.done(gen, err)
+
+	return tx, err
+}
+
+func (c *wrapConn) Ping(ctx context.Context) error {
+	p, ok := c.Conn.(driver.Pinger)
+	if !ok {
+		return nil
+	}
+
+	gen, err := c.breaker.allow()
+	if err != nil {
+		return err
+	}
+
+	err = p.Ping(ctx)
+	c.breaker.done(gen, err)
+	return err
+}
+
+func (c *wrapConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (c *wrapConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+
+	return true
+}
+
+func (c *wrapConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+
+	return driver.ErrSkip
+}
+
+type wrapStmt struct {
+	driver.Stmt
+	conn    driver.Conn
+	breaker *breaker
+}
+
+func (s *wrapStmt) Exec(args []driver.Value) (driver.Result, error) {
+	gen, err := s.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.Stmt.Exec(args) // nolint:staticcheck
+	s.breaker.done(gen, err)
+	return result, err
+}
+
+func (s *wrapStmt) Query(args []driver.Value) (driver.Rows, error) {
+	gen, err := s.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.Stmt.Query(args) // nolint:staticcheck
+	s.breaker.done(gen, err)
+	return rows, err
+}
+
+func (s *wrapStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := s.Stmt.(driver.StmtExecContext)
+	if !ok {
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.Exec(values)
+	}
+
+	gen, err := s.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := e.ExecContext(ctx, args)
+	s.breaker.done(gen, err)
+	return result, err
+}
+
+func (s *wrapStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := s.Stmt.(driver.StmtQueryContext)
+	if !ok {
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.Query(values)
+	}
+
+	gen, err := s.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.QueryContext(ctx, args)
+	s.breaker.done(gen, err)
+	return rows, err
+}
+
+// CheckNamedValue 按database/sql的顺序使用原stmt、原连接的参数转换
+func (s *wrapStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+
+	if n, ok := s.conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+
+	if cc, ok := s.Stmt.(driver.ColumnConverter); ok { // nolint:staticcheck
+		v, err := cc.ColumnConverter(nv.Ordinal - 1).ConvertValue(nv.Value)
+		if err != nil {
+			return err
+		}
+
+		if !driver.IsValue(v) {
+			return errors.New("driver ColumnConverter error converted to non-Value")
+		}
+		nv.Value = v
+		return nil
+	}
+
+	return driver.ErrSkip
+}
+
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("driver does not support the use of Named Parameters")
+		}
+		values[i] = arg.Value
+	}
+
+	return values, nil
+}
@@ -0,0 +1,267 @@
+package shiba
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 分片策略
+const (
+	ShardStrategyHash  = "hash"  // 整数key取模，字符串key取crc32后取模
+	ShardStrategyRange = "range" // 整数key按ranges区间划分
+)
+
+// shardConfig 分片组，databases为database配置中的数据库名，按分片顺序排列
+//
+//	databaseShard:
+//	  order:
+//	    strategy: range
+//	    databases: [order_0, order_1, order_2]
+//	    ranges: [1000000, 2000000] # key<1000000在order_0，key<2000000在order_1，其余在order_2
+type shardConfig struct {
+	Strategy  string   `yaml:"strategy"` // hash range
+	Databases []string `yaml:"databases"`
+	Ranges    []int64  `yaml:"ranges"` // range策略每个分片的上限（不包含），最后一个分片没有上限
+}
+
+func (cfg shardConfig) validate(dbs map[string]databaseConfig) error {
+	if len(cfg.Databases) == 0 {
+		return errors.New("databases is empty")
+	}
+
+	for _, name := range cfg.Databases {
+		dbCfg, ok := dbs[name]
+		if !ok {
+			return errors.New("cant find sql config:" + name)
+		}
+
+		if dbCfg.Disable {
+			return errors.New("sql config is disable:" + name)
+		}
+	}
+
+	switch cfg.Strategy {
+	case ShardStrategyHash:
+	case ShardStrategyRange:
+		if len(cfg.Ranges) != len(cfg.Databases)-1 {
+			return fmt.Errorf("ranges length must be %d", len(cfg.Databases)-1)
+		}
+
+		for i := 1; i < len(cfg.Ranges); i++ {
+			if cfg.Ranges[i] <= cfg.Ranges[i-1] {
+				return errors.New("ranges must be ascending")
+			}
+		}
+	default:
+		return errors.New("unsupported strategy:" + cfg.Strategy)
+	}
+
+	return nil
+}
+
+// index 计算key所在的分片
+func (cfg shardConfig) index(key interface{}) (int, error) {
+	n, isInt := shardIntKey(key)
+
+	if cfg.Strategy == ShardStrategyRange {
+		if !isInt {
+			return 0, fmt.Errorf("range shard key must be integer, found: %T", key)
+		}
+
+		if shardKeyOverflow(key) {
+			return 0, fmt.Errorf("range shard key overflows int64: %v", key)
+		}
+
+		for i, upper := range cfg.Ranges {
+			if n < upper {
+				return i, nil
+			}
+		}
+
+		return len(cfg.Ranges), nil
+	}
+
+	var h uint64
+	if isInt {
+		// 按位转换，负数和超过MaxInt64的uint64都不会溢出
+		h = uint64(n)
+	} else {
+		switch k := key.(type) {
+		case string:
+			h = uint64(crc32.ChecksumIEEE([]byte(k)))
+		case []byte:
+			h = uint64(crc32.ChecksumIEEE(k))
+		default:
+			return 0, fmt.Errorf("unsupported shard key type: %T", key)
+		}
+	}
+
+	return int(h % uint64(len(cfg.Databases))), nil
+}
+
+// shardIntKey 整数key转换为int64，超过MaxInt64的无符号数转换后为负数
+func shardIntKey(key interface{}) (int64, bool) {
+	switch k := key.(type) {
+	case int:
+		return int64(k), true
+	case int8:
+		return int64(k), true
+	case int16:
+		return int64(k), true
+	case int32:
+		return int64(k), true
+	case int64:
+		return k, true
+	case uint:
+		return int64(k), true
+	case uint8:
+		return int64(k), true
+	case uint16:
+		return int64(k), true
+	case uint32:
+		return int64(k), true
+	case uint64:
+		return int64(k), true
+	}
+
+	return 0, false
+}
+
+// shardKeyOverflow 无符号整数key是否超过MaxInt64
+func shardKeyOverflow(key interface{}) bool {
+	switch k := key.(type) {
+	case uint:
+		return uint64(k) > math.MaxInt64
+	case uint64:
+		return k > math.MaxInt64
+	}
+
+	return false
+}
+
+// Shard 分片组中的一个分片
+type Shard struct {
+	Group string
+	Index int
+	Name  string // 数据库配置名
+
+	db *database
+}
+
+func (s Shard) Master() (*sqlx.DB, error) {
+	return s.db.Master(s.Name)
+}
+
+func (s Shard) Slave() (*sqlx.DB, error) {
+	return s.db.Slave(s.Name)
+}
+
+func (p *database) validateShards() error {
+	for group, cfg := range p.Shards {
+		if err := cfg.validate(p.Config); err != nil {
+			return fmt.Errorf("shard group %s:%w", group, err)
+		}
+	}
+
+	return nil
+}
+
+// shard 返回key所在的分片
+func (p *database) shard(group string, key interface{}) (Shard, error) {
+	cfg, ok := p.Shards[group]
+	if !ok {
+		return Shard{}, errors.New("cant find shard group:" + group)
+	}
+
+	i, err := cfg.index(key)
+	if err != nil {
+		return Shard{}, fmt.Errorf("shard group %s:%w", group, err)
+	}
+
+	return Shard{Group: group, Index: i, Name: cfg.Databases[i], db: p}, nil
+}
+
+func (p *database) shards(group string) ([]Shard, error) {
+	cfg, ok := p.Shards[group]
+	if !ok {
+		return nil, errors.New("cant find shard group:" + group)
+	}
+
+	shards := make([]Shard, len(cfg.Databases))
+	for i, name := range cfg.Databases {
+		shards[i] = Shard{Group: group, Index: i, Name: name, db: p}
+	}
+
+	return shards, nil
+}
+
+// scatter 在每个分片上并发执行fn，任意分片出错时取消其他分片的ctx，返回第一个错误
+func (p *database) scatter(ctx context.Context, group string, fn func(ctx context.Context, shard Shard) error) error {
+	shards, err := p.shards(group)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for _, shard := range shards {
+		wg.Add(1)
+		go func(shard Shard) {
+			defer wg.Done()
+
+			if err := fn(ctx, shard); err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("shard %s:%w", shard.Name, err)
+					cancel()
+				})
+			}
+		}(shard)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// ShardSelect 在分片组每个分片的从库上执行查询，按分片顺序合并结果，占位符由驱动按数据库配置重写
+func ShardSelect[T any](ctx context.Context, group, query string, args ...interface{}) ([]T, error) {
+	return shardSelect[T](ctx, db, group, query, args...)
+}
+
+func shardSelect[T any](ctx context.Context, p *database, group, query string, args ...interface{}) ([]T, error) {
+	shards, err := p.shards(group)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([][]T, len(shards))
+	err = p.scatter(ctx, group, func(ctx context.Context, shard Shard) error {
+		xdb, err := shard.Slave()
+		if err != nil {
+			return err
+		}
+
+		return xdb.SelectContext(ctx, &results[shard.Index], query, args...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []T
+	for _, result := range results {
+		rows = append(rows, result...)
+	}
+
+	return rows, nil
+}
@@ -0,0 +1,115 @@
+package shiba
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestShardIndex(t *testing.T) {
+	hash := shardConfig{Strategy: ShardStrategyHash, Databases: []string{"a", "b", "c"}}
+	rng := shardConfig{Strategy: ShardStrategyRange, Databases: []string{"a", "b", "c"}, Ranges: []int64{100, 200}}
+
+	tests := []struct {
+		cfg  shardConfig
+		key  interface{}
+		want int
+	}{
+		{hash, 7, 1},
+		{hash, int64(-7), 0}, // 按uint64取模
+		{hash, int64(math.MinInt64), 2},
+		{hash, uint64(math.MaxUint64), 0},
+		{hash, uint32(9), 0},
+		{rng, 99, 0},
+		{rng, 100, 1},
+		{rng, int64(1000), 2},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.cfg.index(tt.key)
+		if err != nil || got != tt.want {
+			t.Fatalf("%s index(%v) = %d, %v, want %d", tt.cfg.Strategy, tt.key, got, err, tt.want)
+		}
+	}
+
+	s1, _ := hash.index("user-1")
+	s2, _ := hash.index("user-1")
+	if s1 != s2 {
+		t.Fatal("hash of string key should be stable")
+	}
+
+	if _, err := rng.index("user-1"); err == nil {
+		t.Fatal("range strategy should reject string key")
+	}
+
+	if _, err := rng.index(uint64(math.MaxUint64)); err == nil {
+		t.Fatal("range strategy should reject uint64 key overflows int64")
+	}
+
+	if err := rng.validate(map[string]databaseConfig{"a": {}, "b": {}}); err == nil {
+		t.Fatal("expect error for missing database")
+	}
+}
+
+func TestShardSelect(t *testing.T) {
+	d := &database{
+		Config: map[string]databaseConfig{
+			"order_0": {DriverName: DriverSQLite, Master: connectConfig{DataSourceName: "file::memory:"}},
+			"order_1": {DriverName: DriverSQLite, Master: connectConfig{DataSourceName: "file::memory:"}},
+		},
+		Shards: map[string]shardConfig{
+			"order": {Strategy: ShardStrategyHash, Databases: []string{"order_0", "order_1"}},
+		},
+	}
+	d.Init()
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	ctx := context.Background()
+	err := d.scatter(ctx, "order", func(ctx context.Context, shard Shard) error {
+		xdb, err := shard.Master()
+		if err != nil {
+			return err
+		}
+
+		_, err = xdb.ExecContext(ctx, "CREATE TABLE orders (id INTEGER PRIMARY KEY)")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id := 1; id <= 4; id++ {
+		shard, err := d.shard("order", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		xdb, err := shard.Master()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = xdb.Exec("INSERT INTO orders (id) VALUES (?)", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids, err := shardSelect[int](ctx, d, "order", "SELECT id FROM orders ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// order_0: 2 4, order_1: 1 3
+	want := []int{2, 4, 1, 3}
+	if len(ids) != len(want) {
+		t.Fatalf("ids = %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("ids = %v, want %v", ids, want)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package shiba
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	roleMaster = "master"
+	roleSlave  = "slave"
+)
+
+func init() {
+	prometheus.MustRegister(&dbStatsCollector{db: db})
+}
+
+var (
+	dbStatsLabels = []string{"name", "role"}
+
+	dbMaxOpenDesc = prometheus.NewDesc("shiba_database_max_open_connections",
+		"Maximum number of open connections to the database.", dbStatsLabels, nil)
+	dbOpenDesc = prometheus.NewDesc("shiba_database_open_connections",
+		"The number of established connections both in use and idle.", dbStatsLabels, nil)
+	dbInUseDesc = prometheus.NewDesc("shiba_database_in_use_connections",
+		"The number of connections currently in use.", dbStatsLabels, nil)
+	dbIdleDesc = prometheus.NewDesc("shiba_database_idle_connections",
+		"The number of idle connections.", dbStatsLabels, nil)
+	dbWaitCountDesc = prometheus.NewDesc("shiba_database_wait_count_total",
+		"The total number of connections waited for.", dbStatsLabels, nil)
+	dbWaitDurationDesc = prometheus.NewDesc("shiba_database_wait_duration_seconds_total",
+		"The total time blocked waiting for a new connection.", dbStatsLabels, nil)
+	dbBreakerStateDesc = prometheus.NewDesc("shiba_database_circuit_breaker_state",
+		"State of the circuit breaker: 0 closed, 1 half-open, 2 open.", dbStatsLabels, nil)
+	dbBreakerRejectedDesc = prometheus.NewDesc("shiba_database_circuit_breaker_rejected_total",
+		"The total number of requests rejected by the circuit breaker.", dbStatsLabels, nil)
+)
+
+var breakerStateValues = map[string]float64{
+	BreakerClosed:   0,
+	BreakerHalfOpen: 1,
+	BreakerOpen:     2,
+}
+
+// dbStatsCollector 采集时读取每个连接池的sql.DBStats
+type dbStatsCollector struct {
+	db *database
+}
+
+func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dbMaxOpenDesc
+	ch <- dbOpenDesc
+	ch <- dbInUseDesc
+	ch <- dbIdleDesc
+	ch <- dbWaitCountDesc
+	ch <- dbWaitDurationDesc
+	ch <- dbBreakerStateDesc
+	ch <- dbBreakerRejectedDesc
+}
+
+func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.db.eachPool(func(name, role string, xdb *sqlx.DB) {
+		stats := xdb.Stats()
+		ch <- prometheus.MustNewConstMetric(dbMaxOpenDesc, prometheus.GaugeValue, float64(stats.MaxOpenConnections), name, role)
+		ch <- prometheus.MustNewConstMetric(dbOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections), name, role)
+		ch <- prometheus.MustNewConstMetric(dbInUseDesc, prometheus.GaugeValue, float64(stats.InUse), name, role)
+		ch <- prometheus.MustNewConstMetric(dbIdleDesc, prometheus.GaugeValue, float64(stats.Idle), name, role)
+		ch <- prometheus.MustNewConstMetric(dbWaitCountDesc, prometheus.CounterValue, float64(stats.WaitCount), name, role)
+		ch <- prometheus.MustNewConstMetric(dbWaitDurationDesc, prometheus.CounterValue, stats.WaitDuration.Seconds(), name, role)
+
+		if brk := c.db.breakers[name+"/"+role]; brk != nil {
+			ch <- prometheus.MustNewConstMetric(dbBreakerStateDesc, prometheus.GaugeValue, breakerStateValues[brk.State()], name, role)
+			ch <- prometheus.MustNewConstMetric(dbBreakerRejectedDesc, prometheus.CounterValue, float64(brk.Rejected()), name, role)
+		}
+	})
+}
+
+// eachPool 遍历已经建立的连接池
+func (p *database) eachPool(f func(name, role string, xdb *sqlx.DB)) {
+	p.dbsMu.RLock()
+	defer p.dbsMu.RUnlock()
+
+	for name, xdb := range p.dbMasters {
+		f(name, roleMaster, xdb)
+	}
+
+	for name, xdb := range p.dbSlaves {
+		// 从库未配置时使用的是主库连接池
+		if xdb == p.dbMasters[name] {
+			continue
+		}
+		f(name, roleSlave, xdb)
+	}
+}
+
+type poolStats struct {
+	Name              string `json:"name"`
+	Role              string `json:"role"`
+	MaxOpenConns      int    `json:"maxOpenConns"`
+	MaxIdleConns      int    `json:"maxIdleConns"`
+	ConnMaxIdleTime   string `json:"connMaxIdleTime"`
+	ConnMaxLifetime   string `json:"connMaxLifetime"`
+	OpenConnections   int    `json:"openConnections"`
+	InUse             int    `json:"inUse"`
+	Idle              int    `json:"idle"`
+	WaitCount         int64  `json:"waitCount"`
+	WaitDuration      string `json:"waitDuration"`
+	MaxIdleClosed     int64  `json:"maxIdleClosed"`
+	MaxIdleTimeClosed int64  `json:"maxIdleTimeClosed"`
+	MaxLifetimeClosed int64  `json:"maxLifetimeClosed"`
+	BreakerState      string `json:"breakerState,omitempty"`
+}
+
+// Stats 返回所有已建立连接池的状态
+func (p *database) Stats() []poolStats {
+	var list []poolStats
+	p.eachPool(func(name, role string, xdb *sqlx.DB) {
+		connCfg := p.Config[name].Master
+		if role == roleSlave {
+			connCfg = p.Config[name].Slave
+		}
+
+		stats := xdb.Stats()
+		ps := poolStats{
+			Name:              name,
+			Role:              role,
+			MaxOpenConns:      stats.MaxOpenConnections,
+			MaxIdleConns:      connCfg.maxIdleConns(),
+			ConnMaxIdleTime:   connCfg.ConnMaxIdleTime.String(),
+			ConnMaxLifetime:   connCfg.ConnMaxLifetime.String(),
+			OpenConnections:   stats.OpenConnections,
+			InUse:             stats.InUse,
+			Idle:              stats.Idle,
+			WaitCount:         stats.WaitCount,
+			WaitDuration:      stats.WaitDuration.String(),
+			MaxIdleClosed:     stats.MaxIdleClosed,
+			MaxIdleTimeClosed: stats.MaxIdleTimeClosed,
+			MaxLifetimeClosed: stats.MaxLifetimeClosed,
+		}
+		if brk := p.breakers[name+"/"+role]; brk != nil {
+			ps.BreakerState = brk.State()
+		}
+
+		list = append(list, ps)
+	})
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Role < list[j].Role
+	})
+
+	return list
+}
+
+// poolSetting 调整连接池参数，未设置的字段保持不变
+type poolSetting struct {
+	Name            string  `json:"name"`
+	Role            string  `json:"role"` // master slave 为空时主从都调整
+	MaxOpenConns    *int    `json:"maxOpenConns"`
+	MaxIdleConns    *int    `json:"maxIdleConns"`
+	ConnMaxIdleTime *string `json:"connMaxIdleTime"` // time.Duration格式 如 30s 5m
+	ConnMaxLifetime *string `json:"connMaxLifetime"`
+}
+
+func (s poolSetting) apply(connCfg *connectConfig) error {
+	if s.MaxOpenConns != nil {
+		connCfg.MaxOpenConns = *s.MaxOpenConns
+	}
+
+	if s.MaxIdleConns != nil {
+		connCfg.MaxIdleConns = *s.MaxIdleConns
+	}
+
+	if s.ConnMaxIdleTime != nil {
+		d, err := time.ParseDuration(*s.ConnMaxIdleTime)
+		if err != nil {
+			return err
+		}
+		connCfg.ConnMaxIdleTime = d
+	}
+
+	if s.ConnMaxLifetime != nil {
+		d, err := time.ParseDuration(*s.ConnMaxLifetime)
+		if err != nil {
+			return err
+		}
+		connCfg.ConnMaxLifetime = d
+	}
+
+	return nil
+}
+
+// SetPool 调整连接池参数，已建立的连接池立即生效
+func (p *database) SetPool(setting poolSetting) error {
+	if setting.Role != "" && setting.Role != roleMaster && setting.Role != roleSlave {
+		return errors.New("role must be master or slave:" + setting.Role)
+	}
+
+	p.dbsMu.Lock()
+	defer p.dbsMu.Unlock()
+
+	cfg, ok := p.Config[setting.Name]
+	if !ok {
+		return errors.New("cant find sql config:" + setting.Name)
+	}
+
+	if setting.Role == "" || setting.Role == roleMaster {
+		if err := setting.apply(&cfg.Master); err != nil {
+			return err
+		}
+
+		if xdb, ok := p.dbMasters[setting.Name]; ok {
+			setPoolLimits(xdb, cfg.Master)
+		}
+	}
+
+	if setting.Role == "" || setting.Role == roleSlave {
+		if err := setting.apply(&cfg.Slave); err != nil {
+			return err
+		}
+
+		if xdb, ok := p.dbSlaves[setting.Name]; ok && xdb != p.dbMasters[setting.Name] {
+			setPoolLimits(xdb, cfg.Slave)
+		}
+	}
+
+	p.Config[setting.Name] = cfg
+	defaultLogger.Clone("database").Infof("%s pool changed, master:%s slave:%s",
+		setting.Name, cfg.Master.limits(), cfg.Slave.limits())
+
+	return nil
+}
+
+// ServeHTTP 查看和调整连接池
+//
+// GET 返回所有已建立连接池的状态
+//
+//	curl localhost:9999/database/pool
+//
+// PUT 调整连接池参数
+//
+//	curl -X PUT localhost:9999/database/pool -d '{"name":"default","role":"master","maxOpenConns":50}'
+func (p *database) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	type errorResponse struct {
+		Error string `json:"error"`
+	}
+
+	enc := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		enc.Encode(p.Stats())
+	case http.MethodPut:
+		var setting poolSetting
+		if err := json.NewDecoder(r.Body).Decode(&setting); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(errorResponse{Error: err.Error()})
+			return
+		}
+
+		if err := p.SetPool(setting); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			enc.Encode(errorResponse{Error: err.Error()})
+			return
+		}
+
+		enc.Encode(p.Stats())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		enc.Encode(errorResponse{Error: "Only GET and PUT are supported."})
+	}
+}
+
+// Reload 配置重新加载时调整连接池参数
+// 新增的数据库配置在首次使用时建立连接，disable立即生效
+// driverName、dataSourceName、startupPolicy的修改需要重启服务，
+// circuitBreaker、disableRebind在连接池建立后也需要重启服务
+func (p *database) Reload(node *yaml.Node) error {
+	var newCfg struct {
+		Config map[string]databaseConfig `yaml:"database"`
+	}
+	if err := node.Decode(&newCfg); err != nil {
+		return err
+	}
+
+	// 有不合法的配置时全部不生效
+	for name, cfg := range newCfg.Config {
+		if cfg.Disable {
+			continue
+		}
+
+		if err := cfg.validate(); err != nil {
+			return errors.New(name + " " + err.Error())
+		}
+	}
+
+	logger := defaultLogger.Clone("database")
+
+	p.dbsMu.Lock()
+	defer p.dbsMu.Unlock()
+
+	if p.Config == nil {
+		p.Config = make(map[string]databaseConfig)
+	}
+
+	for name, cfg := range newCfg.Config {
+		oldCfg, ok := p.Config[name]
+		if !ok {
+			p.Config[name] = cfg
+			continue
+		}
+
+		if cfg.DriverName != oldCfg.DriverName ||
+			cfg.Master.DataSourceName != oldCfg.Master.DataSourceName ||
+			cfg.Slave.DataSourceName != oldCfg.Slave.DataSourceName {
+			logger.Warnf("%s driverName or dataSourceName changed, restart to take effect", name)
+			cfg.DriverName = oldCfg.DriverName
+			cfg.Master.DataSourceName = oldCfg.Master.DataSourceName
+			cfg.Slave.DataSourceName = oldCfg.Slave.DataSourceName
+		}
+
+		// 启动策略只在启动时使用
+		if cfg.StartupPolicy != oldCfg.StartupPolicy {
+			logger.Warnf("%s startupPolicy changed, restart to take effect", name)
+			cfg.StartupPolicy = oldCfg.StartupPolicy
+		}
+
+		// 熔断器和占位符重写在建立连接池时包装到驱动中
+		_, masterOpen := p.dbMasters[name]
+		_, slaveOpen := p.dbSlaves[name]
+		if (masterOpen || slaveOpen) && (cfg.CircuitBreaker != oldCfg.CircuitBreaker ||
+			cfg.DisableRebind != oldCfg.DisableRebind) {
+			logger.Warnf("%s circuitBreaker or disableRebind changed, restart to take effect", name)
+			cfg.CircuitBreaker = oldCfg.CircuitBreaker
+			cfg.DisableRebind = oldCfg.DisableRebind
+		}
+
+		if xdb, ok := p.dbMasters[name]; ok {
+			setPoolLimits(xdb, cfg.Master)
+		}
+
+		if xdb, ok := p.dbSlaves[name]; ok && xdb != p.dbMasters[name] {
+			setPoolLimits(xdb, cfg.Slave)
+		}
+
+		p.Config[name] = cfg
+	}
+
+	return nil
+}
+
+// Health 熔断器打开时不健康
+// 正在后台重连的是background-retry数据库，不影响服务，只在retrying中列出
+func (p *database) Health() (bool, interface{}) {
+	type health struct {
+		Breakers map[string]string `json:"breakers,omitempty"`
+		Retrying []string          `json:"retrying,omitempty"` // 正在后台重连，不影响健康状态
+	}
+
+	p.dbsMu.RLock()
+	defer p.dbsMu.RUnlock()
+
+	healthy := true
+	var h health
+	for name, brk := range p.breakers {
+		state := brk.State()
+		if state == BreakerOpen {
+			healthy = false
+		}
+
+		if h.Breakers == nil {
+			h.Breakers = make(map[string]string)
+		}
+		h.Breakers[name] = state
+	}
+
+	for name := range p.retrying {
+		h.Retrying = append(h.Retrying, name)
+	}
+	sort.Strings(h.Retrying)
+
+	return healthy, h
+}
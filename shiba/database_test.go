@@ -1,9 +1,259 @@
 package shiba
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/windzhu0514/shiba/log"
 )
 
+func TestMain(m *testing.M) {
+	defaultLogger = log.New("shiba", nil, log.Config{Level: log.ErrorLevel})
+	os.Exit(m.Run())
+}
+
 func TestCheckError(t *testing.T) {
 
 }
+
+func newTestDatabase(t *testing.T) *database {
+	t.Helper()
+
+	d := &database{Config: map[string]databaseConfig{
+		"default": {
+			DriverName: "sqlite3",
+			Master:     connectConfig{DataSourceName: "file::memory:"},
+		},
+	}}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Stop() })
+
+	return d
+}
+
+func TestDatabaseSQLite(t *testing.T) {
+	d := newTestDatabase(t)
+
+	xdb, err := d.Master("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if xdb.DriverName() != DriverSQLite {
+		t.Fatalf("driverName = %s, want %s", xdb.DriverName(), DriverSQLite)
+	}
+
+	if _, err = xdb.Exec("CREATE TABLE user (id INTEGER PRIMARY KEY, name TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = xdb.Exec(xdb.Rebind("INSERT INTO user (name) VALUES (?)"), "shiba"); err != nil {
+		t.Fatal(err)
+	}
+
+	var name string
+	if err = xdb.Get(&name, "SELECT name FROM user WHERE id = ?", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "shiba" {
+		t.Fatalf("name = %s, want shiba", name)
+	}
+
+	// 未配置从库时使用主库
+	slave, err := d.Slave("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slave != xdb {
+		t.Fatal("slave should fall back to master")
+	}
+}
+
+func TestNormalizeDriverName(t *testing.T) {
+	tests := map[string]string{
+		"mysql":      DriverMySQL,
+		"postgresql": DriverPostgres,
+		"postgres":   DriverPostgres,
+		"sqlite3":    DriverSQLite,
+	}
+
+	for in, want := range tests {
+		got, err := normalizeDriverName(in)
+		if err != nil || got != want {
+			t.Fatalf("normalizeDriverName(%s) = %s, %v, want %s", in, got, err, want)
+		}
+	}
+
+	if _, err := normalizeDriverName("oracle"); err == nil {
+		t.Fatal("expect error for unsupported driver")
+	}
+}
+
+func TestDatabasePool(t *testing.T) {
+	d := newTestDatabase(t)
+	if _, err := d.Master(""); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/database/pool",
+		strings.NewReader(`{"name":"default","role":"master","maxOpenConns":3,"connMaxLifetime":"1m"}`))
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT status = %d, body = %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	d.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/database/pool", nil))
+
+	var stats []poolStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats) != 1 || stats[0].MaxOpenConns != 3 || stats[0].ConnMaxLifetime != "1m0s" {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	if err := d.SetPool(poolSetting{Name: "unknown"}); err == nil {
+		t.Fatal("expect error for unknown database")
+	}
+}
+
+func TestDatabaseStartupPolicy(t *testing.T) {
+	badCfg := func(policy string) databaseConfig {
+		return databaseConfig{
+			DriverName:    DriverSQLite,
+			StartupPolicy: policy,
+			Master:        connectConfig{DataSourceName: "file:/nonexistent/shiba.db?mode=ro"},
+		}
+	}
+
+	d := &database{Config: map[string]databaseConfig{"bad": badCfg(StartupPolicyFailFast)}}
+	d.Init()
+	if err := d.Start(); err == nil {
+		t.Fatal("fail-fast: expect start error")
+	}
+	d.Stop()
+
+	d = &database{Config: map[string]databaseConfig{
+		"lazy":  badCfg(StartupPolicyLazy),
+		"retry": badCfg(StartupPolicyBackgroundRetry),
+	}}
+	d.Init()
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	if _, err := d.Master("retry"); !errors.Is(err, ErrDBConnecting) {
+		t.Fatalf("background-retry: err = %v, want ErrDBConnecting", err)
+	}
+
+	// 后台重连的数据库不影响健康状态
+	if healthy, detail := d.Health(); !healthy {
+		t.Fatalf("background-retry: unhealthy %+v", detail)
+	}
+
+	if _, err := d.Master("lazy"); err == nil || errors.Is(err, ErrDBConnecting) {
+		t.Fatalf("lazy: err = %v, want connect error", err)
+	}
+}
+
+func TestDatabaseReload(t *testing.T) {
+	d := newTestDatabase(t)
+
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(`
+database:
+  added:
+    driverName: sqlite
+    master:
+      dataSourceName: "file::memory:"
+  bad:
+    driverName: oracle
+    master:
+      dataSourceName: x
+`), &node); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Reload(&node); err == nil {
+		t.Fatal("expect error for unsupported driver")
+	}
+	if _, ok := d.Config["added"]; ok {
+		t.Fatal("config applied with invalid database")
+	}
+}
+
+func TestDatabaseReloadLivePool(t *testing.T) {
+	d := newTestDatabase(t)
+	if _, err := d.Master(""); err != nil {
+		t.Fatal(err)
+	}
+
+	reload := func(cfg string) {
+		t.Helper()
+		var node yaml.Node
+		if err := yaml.Unmarshal([]byte(cfg), &node); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Reload(&node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 已建立的连接池不能修改熔断器、占位符重写和启动策略
+	reload(`
+database:
+  default:
+    driverName: sqlite3
+    startupPolicy: lazy
+    disableRebind: true
+    circuitBreaker:
+      enable: true
+    master:
+      dataSourceName: "file::memory:"
+`)
+	cfg := d.Config["default"]
+	if cfg.StartupPolicy != "" || cfg.DisableRebind || cfg.CircuitBreaker.Enable {
+		t.Fatalf("config %+v", cfg)
+	}
+
+	reload(`
+database:
+  default:
+    disable: true
+    driverName: sqlite3
+    master:
+      dataSourceName: "file::memory:"
+`)
+	if _, err := d.Master(""); err == nil {
+		t.Fatal("expect error for disabled database")
+	}
+
+	reload(`
+database:
+  default:
+    driverName: sqlite3
+    master:
+      dataSourceName: "file::memory:"
+`)
+	if _, err := d.Master(""); err != nil {
+		t.Fatal(err)
+	}
+}
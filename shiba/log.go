@@ -1,14 +1,50 @@
 package shiba
 
 import (
+	"context"
 	"strings"
 	"time"
 
+	"github.com/opentracing/opentracing-go"
+
 	"github.com/windzhu0514/shiba/log"
 )
 
 var defaultLogger log.Logger
 
+type requestIDKey struct{}
+
+// ContextWithRequestID 返回带有请求ID的ctx，MiddlewareRequestID会自动设置
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext 返回ctx中的请求ID，没有时返回空
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// loggerWithContext 添加ctx中的traceId、spanId和requestId，没有的字段不添加
+func loggerWithContext(logger log.Logger, ctx context.Context) log.Logger {
+	var fields []interface{}
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		if traceID, spanID := spanContextIDs(span.Context()); traceID != "" {
+			fields = append(fields, "traceId", traceID, "spanId", spanID)
+		}
+	}
+
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		fields = append(fields, "requestId", requestID)
+	}
+
+	if len(fields) == 0 {
+		return logger
+	}
+
+	return logger.With(fields...)
+}
+
 type cronLogger struct {
 	logger log.Logger
 }
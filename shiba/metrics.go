@@ -0,0 +1,196 @@
+package shiba
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsConfig http请求指标，开启WithMetric时自动添加
+//
+//	shiba:
+//	  metrics:
+//	    namespace: order
+//	    buckets: [0.01, 0.05, 0.1, 0.5, 1, 5]
+type MetricsConfig struct {
+	Namespace   string    `yaml:"namespace"`   // 指标名前缀，默认为serviceName，非法字符替换为_
+	Buckets     []float64 `yaml:"buckets"`     // 请求耗时分桶，单位秒，默认prometheus.DefBuckets
+	SizeBuckets []float64 `yaml:"sizeBuckets"` // 响应大小分桶，单位字节，默认100B到100MB
+}
+
+// metricsRouteUnknown 没有匹配到路由(404、405)时的route标签
+const metricsRouteUnknown = "unknown"
+
+type httpMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	size     *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+}
+
+// MiddlewareMetrics 记录请求数、耗时、处理中的请求数和响应大小
+// 标签为method、route(mux的路由模板，不是原始路径)和code，相同namespace多次调用共用指标
+// mux不对未匹配的请求执行Use添加的中间件，需要统计404、405时使用useUnmatched
+func MiddlewareMetrics(cfg MetricsConfig) MiddlewareFunc {
+	if cfg.Namespace == "" {
+		cfg.Namespace = "shiba"
+	}
+	cfg.Namespace = metricsNamespace(cfg.Namespace)
+
+	if len(cfg.Buckets) == 0 {
+		cfg.Buckets = prometheus.DefBuckets
+	}
+
+	if len(cfg.SizeBuckets) == 0 {
+		cfg.SizeBuckets = prometheus.ExponentialBuckets(100, 10, 7)
+	}
+
+	labels := []string{"method", "route", "code"}
+	m := &httpMetrics{
+		requests: registerCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: cfg.Namespace,
+			Name:      "http_requests_total",
+			Help:      "The total number of http requests.",
+		}, labels)).(*prometheus.CounterVec),
+		duration: registerCollector(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: cfg.Namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Http request latency.",
+			Buckets:   cfg.Buckets,
+		}, labels)).(*prometheus.HistogramVec),
+		size: registerCollector(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: cfg.Namespace,
+			Name:      "http_response_size_bytes",
+			Help:      "Http response size.",
+			Buckets:   cfg.SizeBuckets,
+		}, labels)).(*prometheus.HistogramVec),
+		inFlight: registerCollector(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: cfg.Namespace,
+			Name:      "http_requests_in_flight",
+			Help:      "The number of http requests being served.",
+		}, []string{"method", "route"})).(*prometheus.GaugeVec),
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := routeTemplate(r)
+			inFlight := m.inFlight.WithLabelValues(r.Method, route)
+			inFlight.Inc()
+			defer inFlight.Dec()
+
+			start := time.Now()
+			rw := newResponseRecorder(w)
+			next.ServeHTTP(rw, r)
+
+			code := strconv.Itoa(rw.status)
+			m.requests.WithLabelValues(r.Method, route, code).Inc()
+			m.duration.WithLabelValues(r.Method, route, code).Observe(time.Since(start).Seconds())
+			m.size.WithLabelValues(r.Method, route, code).Observe(float64(rw.size))
+		})
+	}
+}
+
+// registerCollector 已注册过相同指标时返回已注册的
+func registerCollector(c prometheus.Collector) prometheus.Collector {
+	if err := prometheus.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+
+	return c
+}
+
+// metricsNamespace 替换指标名中不允许的字符，数字开头时添加_前缀
+func metricsNamespace(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// useUnmatched 未匹配到路由的请求(404、405)也经过中间件
+func useUnmatched(router *mux.Router, mw MiddlewareFunc) {
+	notFound := router.NotFoundHandler
+	if notFound == nil {
+		notFound = http.NotFoundHandler()
+	}
+	router.NotFoundHandler = mw(notFound)
+
+	methodNotAllowed := router.MethodNotAllowedHandler
+	if methodNotAllowed == nil {
+		methodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		})
+	}
+	router.MethodNotAllowedHandler = mw(methodNotAllowed)
+}
+
+// routeTemplate 返回mux匹配到的路由模板，避免路径参数导致标签过多
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+
+	return metricsRouteUnknown
+}
+
+// responseRecorder 记录响应状态码和大小
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *responseRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+
+	return nil, nil, errors.New("hijack not supported")
+}
+
+// Unwrap 供http.ResponseController使用
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
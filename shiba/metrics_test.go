@@ -0,0 +1,67 @@
+package shiba
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddlewareMetrics(t *testing.T) {
+	// 指标注册在全局registry，每次运行使用不同的namespace，-count多次运行时互不影响
+	namespace := fmt.Sprintf("metrics-test-%d", time.Now().UnixNano())
+	mw := MiddlewareMetrics(MetricsConfig{Namespace: namespace, Buckets: []float64{.1, 1}})
+	router := mux.NewRouter()
+	router.Use(mux.MiddlewareFunc(mw))
+	useUnmatched(router, mw)
+	router.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}).Methods(http.MethodPost)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/users/1", nil),
+		httptest.NewRequest(http.MethodPost, "/users/2", nil),
+		httptest.NewRequest(http.MethodGet, "/users/1", nil),
+		httptest.NewRequest(http.MethodGet, "/orders", nil),
+	} {
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// 相同namespace共用指标
+	MiddlewareMetrics(MetricsConfig{Namespace: namespace})
+
+	requests := registerCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace(namespace),
+		Name:      "http_requests_total",
+		Help:      "The total number of http requests.",
+	}, []string{"method", "route", "code"})).(*prometheus.CounterVec)
+	if n := testutil.ToFloat64(requests.WithLabelValues(http.MethodPost, "/users/{id}", "201")); n != 2 {
+		t.Fatalf("requests %v", n)
+	}
+	for code, want := range map[string]float64{"404": 1, "405": 1} {
+		if n := testutil.ToFloat64(requests.WithLabelValues(http.MethodGet, metricsRouteUnknown, code)); n != want {
+			t.Fatalf("%s requests %v", code, n)
+		}
+	}
+	if n := testutil.CollectAndCount(requests); n != 3 {
+		t.Fatalf("series %d", n)
+	}
+}
+
+func TestMetricsNamespace(t *testing.T) {
+	for name, want := range map[string]string{
+		"order-api": "order_api",
+		"9pay":      "_9pay",
+		"pay.v2":    "pay_v2",
+	} {
+		if got := metricsNamespace(name); got != want {
+			t.Errorf("%s got %s want %s", name, got, want)
+		}
+	}
+}
@@ -2,38 +2,59 @@ package shiba
 
 import (
 	"context"
-	"io"
 	"net/http"
 	"runtime/debug"
-	"time"
 
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
-	"github.com/uber/jaeger-client-go"
-	"github.com/uber/jaeger-client-go/config"
+
+	"github.com/windzhu0514/shiba/utils"
 )
 
 type MiddlewareFunc func(http.Handler) http.Handler
 
-func newJaegerTracer(serviceName, agentHostPort string) (io.Closer, error) {
-	cfg := &config.Configuration{
-		ServiceName: serviceName,
-		Sampler: &config.SamplerConfig{
-			Type:  "const",
-			Param: 1,
-		},
-		Reporter: &config.ReporterConfig{
-			LogSpans:            true,
-			BufferFlushInterval: 1 * time.Second,
-			LocalAgentHostPort:  agentHostPort,
-		},
+// RequestIDHeader 请求ID的请求头和响应头
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen 请求头中X-Request-ID的最大长度
+const maxRequestIDLen = 128
+
+// validRequestID 长度不超过maxRequestIDLen，只包含字母、数字和._-
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
 	}
-	tracer, closer, err := cfg.NewTracer()
-	if err != nil {
-		return nil, err
+
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
 	}
-	opentracing.SetGlobalTracer(tracer)
-	return closer, nil
+
+	return true
+}
+
+// MiddlewareRequestID 请求头中没有X-Request-ID或格式不合法时生成一个，写入响应头和请求的ctx
+// 通过RequestIDFromContext获取，LoggerCtx会自动添加到日志中
+func MiddlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = utils.UUID()
+			r.Header.Set(RequestIDHeader, requestID)
+		}
+
+		w.Header().Set(RequestIDHeader, requestID)
+		if ids := accessLogIDsFromContext(r.Context()); ids != nil {
+			ids.requestID = requestID
+		}
+		if span := opentracing.SpanFromContext(r.Context()); span != nil {
+			span.SetTag("request.id", requestID)
+		}
+
+		next.ServeHTTP(w, r.WithContext(ContextWithRequestID(r.Context(), requestID)))
+	})
 }
 
 func MiddlewareTracing(next http.Handler) http.Handler {
@@ -54,17 +75,16 @@ func MiddlewareTracing(next http.Handler) http.Handler {
 		}
 		defer span.Finish()
 
-		var traceID string
-		var spanID string
-		var spanContext = span.Context()
-		switch spanContext.(type) {
-		case jaeger.SpanContext:
-			jaegerContext := spanContext.(jaeger.SpanContext)
-			traceID = jaegerContext.TraceID().String()
-			spanID = jaegerContext.SpanID().String()
+		if requestID := RequestIDFromContext(r.Context()); requestID != "" {
+			span.SetTag("request.id", requestID)
 		}
+
+		traceID, spanID := spanContextIDs(span.Context())
 		r.Header.Set("X-Trace-ID", traceID)
 		r.Header.Set("X-Span-ID", spanID)
+		if ids := accessLogIDsFromContext(r.Context()); ids != nil {
+			ids.traceID = traceID
+		}
 		r = r.WithContext(newCtx)
 
 		next.ServeHTTP(w, r)
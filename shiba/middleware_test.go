@@ -0,0 +1,71 @@
+package shiba
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+
+	"github.com/windzhu0514/shiba/log"
+)
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestMiddlewareRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New("test", nopWriteCloser{&buf}, log.Config{EncoderMode: log.EncoderModeJson})
+
+	tracer, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), jaeger.NewNullReporter())
+	defer closer.Close()
+	span := tracer.StartSpan("test")
+	defer span.Finish()
+
+	var requestID string
+	handler := MiddlewareRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = RequestIDFromContext(r.Context())
+		ctx := opentracing.ContextWithSpan(r.Context(), span)
+		loggerWithContext(logger, ctx).Info("hello")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if requestID == "" || rec.Header().Get(RequestIDHeader) != requestID {
+		t.Fatalf("request id %q response %q", requestID, rec.Header().Get(RequestIDHeader))
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["requestId"] != requestID || fields["traceId"] == nil || fields["spanId"] == nil {
+		t.Fatalf("fields %v", fields)
+	}
+
+	// 使用请求头中的ID
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if requestID != "abc" || rec.Header().Get(RequestIDHeader) != "abc" {
+		t.Fatalf("request id %q", requestID)
+	}
+
+	// 不合法的ID重新生成
+	for _, id := range []string{"a b\ninjected", strings.Repeat("a", maxRequestIDLen+1)} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(RequestIDHeader, id)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if requestID == id || !validRequestID(requestID) || rec.Header().Get(RequestIDHeader) != requestID {
+			t.Fatalf("request id %q", requestID)
+		}
+	}
+}
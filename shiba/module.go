@@ -3,6 +3,8 @@ package shiba
 import (
 	"reflect"
 	"sort"
+
+	"gopkg.in/yaml.v3"
 )
 
 type Module interface {
@@ -12,6 +14,18 @@ type Module interface {
 	Stop() error  // 停止模块
 }
 
+// Reloader 模块实现该接口后，重新加载配置文件时调用Reload
+// node为整个配置文件，模块自行解码需要的配置，未实现的模块配置修改需要重启生效
+type Reloader interface {
+	Reload(node *yaml.Node) error
+}
+
+// HealthChecker 模块实现该接口后，状态会出现在健康检查接口/health中
+// detail会被编码为json
+type HealthChecker interface {
+	Health() (healthy bool, detail interface{})
+}
+
 type module struct {
 	Name     string
 	Priority int
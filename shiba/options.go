@@ -30,6 +30,13 @@ func WithCron() Option {
 	}
 }
 
+// WithAdmin 开启管理接口/config/reload、/database/pool和定时任务的/cron、/cron/trigger，会修改运行中的配置，只在内网或有签名校验时开启
+func WithAdmin() Option {
+	return func(s *Server) {
+		s.Config.openAdmin = true
+	}
+}
+
 func WithMetric() Option {
 	return func(s *Server) {
 		s.Config.openMetric = true
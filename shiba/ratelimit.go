@@ -0,0 +1,328 @@
+package shiba
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+
+	"github.com/windzhu0514/shiba/utils"
+)
+
+// 限流算法
+const (
+	RateLimitSlidingWindow = "sliding-window" // 滑动窗口：window内最多limit个请求
+	RateLimitTokenBucket   = "token-bucket"   // 令牌桶：容量limit，每window补充limit个令牌，允许突发
+)
+
+// RateLimitKeyFunc 从请求中提取限流key，返回空字符串时不限流
+type RateLimitKeyFunc func(r *http.Request) string
+
+// RateLimitByIP 按客户端ip限流，使用RemoteAddr，经过代理时使用RateLimitByHeader
+func RateLimitByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// RateLimitByHeader 按请求头限流，如X-Real-IP
+func RateLimitByHeader(name string) RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// RateLimitByAuthID 按authId限流，优先使用X-Auth-Id请求头，否则读取表单jsonStr中的authId
+func RateLimitByAuthID(r *http.Request) string {
+	if authID := r.Header.Get("X-Auth-Id"); authID != "" {
+		return authID
+	}
+
+	// ParseForm会缓存解析结果，后续handler可以再次读取表单
+	if err := r.ParseForm(); err != nil {
+		return ""
+	}
+
+	var req struct {
+		AuthId string `json:"authId"`
+	}
+	if err := json.Unmarshal([]byte(r.PostFormValue("jsonStr")), &req); err != nil {
+		return ""
+	}
+
+	return req.AuthId
+}
+
+type RateLimitConfig struct {
+	RedisName string // redis配置名
+	Algorithm string // sliding-window token-bucket，默认sliding-window
+	Limit     int
+	Window    time.Duration
+	KeyFunc   RateLimitKeyFunc // 默认RateLimitByIP
+	PerRoute  bool             // 按路由分别限流，使用mux路由模板而不是原始路径
+	Prefix    string           // redis key前缀，默认ratelimit
+	Cooldown  time.Duration    // redis不可用后使用进程内限流的时间，之后再尝试redis，默认5s
+}
+
+var (
+	slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], 0, now - window)
+local count = redis.call("ZCARD", KEYS[1])
+if count < limit then
+	redis.call("ZADD", KEYS[1], now, ARGV[4])
+	redis.call("PEXPIRE", KEYS[1], window)
+	return {1, limit - count - 1, 0}
+end
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+return {0, 0, window - (now - tonumber(oldest[2]))}`)
+
+	tokenBucketScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local rate = tonumber(ARGV[3])
+local data = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(data[1]) or capacity
+local ts = tonumber(data[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(capacity / rate))
+return {allowed, math.floor(tokens), retry}`)
+)
+
+// rateLimitResult 限流结果
+type rateLimitResult struct {
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration
+}
+
+type rateLimiter struct {
+	cfg           RateLimitConfig
+	id            string // 实例id，多个实例共用key时滑动窗口zset成员不重复
+	seq           uint64 // 滑动窗口zset成员去重
+	degradedUntil int64  // redis不可用，在此时间(unix纳秒)之前使用进程内限流
+	local         *localLimiter
+}
+
+// MiddlewareRateLimit 基于redis的分布式限流，超过限制返回429和Retry-After
+// redis不可用时降级为进程内令牌桶限流，此时限制按实例计算，配置无效时返回错误
+func MiddlewareRateLimit(cfg RateLimitConfig) (MiddlewareFunc, error) {
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = RateLimitSlidingWindow
+	}
+
+	if cfg.Algorithm != RateLimitSlidingWindow && cfg.Algorithm != RateLimitTokenBucket {
+		return nil, errors.New("ratelimit:unsupported algorithm:" + cfg.Algorithm)
+	}
+
+	if cfg.Limit <= 0 {
+		return nil, errors.New("ratelimit:limit must be positive")
+	}
+
+	// redis脚本按毫秒计算，window不足1ms时速率除以0
+	if cfg.Window < time.Millisecond {
+		return nil, errors.New("ratelimit:window must be at least 1ms")
+	}
+
+	if cfg.KeyFunc == nil {
+		cfg.KeyFunc = RateLimitByIP
+	}
+
+	if cfg.Prefix == "" {
+		cfg.Prefix = "ratelimit"
+	}
+
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 5 * time.Second
+	}
+
+	limiter := &rateLimiter{cfg: cfg, id: utils.UUID(), local: newLocalLimiter(cfg.Limit, cfg.Window)}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := cfg.KeyFunc(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key = cfg.Prefix + ":" + key
+			if cfg.PerRoute {
+				route := r.URL.Path
+				if current := mux.CurrentRoute(r); current != nil {
+					if tpl, err := current.GetPathTemplate(); err == nil {
+						route = tpl
+					}
+				}
+				key += ":" + route
+			}
+
+			result := limiter.allow(r.Context(), key)
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(cfg.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.remaining))
+
+			if !result.allowed {
+				retryAfter := int(math.Ceil(result.retryAfter.Seconds()))
+				if retryAfter < 1 {
+					retryAfter = 1
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// allow redis不可用时在cooldown内只使用进程内限流，避免每个请求都等待redis超时
+// cooldown结束后只有一个请求尝试redis，其余请求继续使用进程内限流
+func (l *rateLimiter) allow(ctx context.Context, key string) rateLimitResult {
+	if until := atomic.LoadInt64(&l.degradedUntil); until != 0 {
+		now := time.Now()
+		if now.UnixNano() < until || !atomic.CompareAndSwapInt64(&l.degradedUntil, until, now.Add(l.cfg.Cooldown).UnixNano()) {
+			return l.local.allow(key)
+		}
+	}
+
+	result, err := l.allowRedis(ctx, key)
+	if err == nil {
+		if atomic.SwapInt64(&l.degradedUntil, 0) != 0 {
+			defaultLogger.Clone("ratelimit").Info("redis recovered, use redis rate limiter")
+		}
+		return result
+	}
+
+	if atomic.SwapInt64(&l.degradedUntil, time.Now().Add(l.cfg.Cooldown).UnixNano()) == 0 {
+		defaultLogger.Clone("ratelimit").Warnf("redis unavailable, fall back to local rate limiter:%s", err.Error())
+	}
+
+	return l.local.allow(key)
+}
+
+func (l *rateLimiter) allowRedis(ctx context.Context, key string) (rateLimitResult, error) {
+	client, err := redisx.Get(l.cfg.RedisName)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	window := l.cfg.Window.Milliseconds()
+
+	var cmd *redis.Cmd
+	if l.cfg.Algorithm == RateLimitTokenBucket {
+		rate := float64(l.cfg.Limit) / float64(window) // 每毫秒补充的令牌
+		cmd = tokenBucketScript.Run(ctx, client, []string{key}, now, l.cfg.Limit, rate)
+	} else {
+		member := strconv.FormatInt(now, 10) + "-" + l.id + "-" + strconv.FormatUint(atomic.AddUint64(&l.seq, 1), 10)
+		cmd = slidingWindowScript.Run(ctx, client, []string{key}, now, window, l.cfg.Limit, member)
+	}
+
+	result, err := cmd.Result()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 3 {
+		return rateLimitResult{}, errors.New("unexpected rate limit script result")
+	}
+
+	allowed, _ := values[0].(int64)
+	remaining, _ := values[1].(int64)
+	retry, _ := values[2].(int64)
+
+	return rateLimitResult{
+		allowed:    allowed == 1,
+		remaining:  int(remaining),
+		retryAfter: time.Duration(retry) * time.Millisecond,
+	}, nil
+}
+
+// localLimiter 进程内令牌桶，redis不可用时使用
+type localLimiter struct {
+	capacity float64
+	rate     float64 // 每纳秒补充的令牌
+	idle     time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*localBucket
+	lastSweep time.Time
+}
+
+type localBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+func newLocalLimiter(limit int, window time.Duration) *localLimiter {
+	return &localLimiter{
+		capacity:  float64(limit),
+		rate:      float64(limit) / float64(window),
+		idle:      window,
+		buckets:   make(map[string]*localBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *localLimiter) allow(key string) rateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &localBucket{tokens: l.capacity, ts: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.capacity, b.tokens+float64(now.Sub(b.ts))*l.rate)
+	b.ts = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return rateLimitResult{allowed: true, remaining: int(b.tokens)}
+	}
+
+	return rateLimitResult{retryAfter: time.Duration((1 - b.tokens) / l.rate)}
+}
+
+// sweep 清理补满的桶，避免key过多时内存增长
+func (l *localLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idle {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.ts) >= l.idle {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package shiba
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/windzhu0514/shiba/utils"
+)
+
+func TestMiddlewareRateLimit(t *testing.T) {
+	servers := newTestRedis(t, "default")
+
+	for _, algorithm := range []string{RateLimitSlidingWindow, RateLimitTokenBucket} {
+		t.Run(algorithm, func(t *testing.T) {
+			mw, err := MiddlewareRateLimit(RateLimitConfig{
+				RedisName: "default",
+				Algorithm: algorithm,
+				Limit:     3,
+				Window:    time.Minute,
+				KeyFunc:   RateLimitByHeader("X-Client"),
+				Prefix:    algorithm,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			do := func(client string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Client", client)
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				return rec
+			}
+
+			for i := 0; i < 3; i++ {
+				if rec := do("a"); rec.Code != http.StatusOK {
+					t.Fatalf("request %d: code %d", i, rec.Code)
+				}
+			}
+
+			rec := do("a")
+			if rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("expect 429, got %d", rec.Code)
+			}
+			if rec.Header().Get("Retry-After") == "" {
+				t.Fatal("missing Retry-After")
+			}
+
+			if rec := do("b"); rec.Code != http.StatusOK {
+				t.Fatalf("other client: code %d", rec.Code)
+			}
+		})
+	}
+
+	// redis不可用时使用进程内限流
+	servers["default"].Close()
+	mw, err := MiddlewareRateLimit(RateLimitConfig{
+		RedisName: "default",
+		Limit:     1,
+		Window:    time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	codes := make([]int, 2)
+	for i := range codes {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		codes[i] = rec.Code
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Fatalf("fallback codes %v", codes)
+	}
+}
+
+func TestMiddlewareRateLimitConfig(t *testing.T) {
+	for _, cfg := range []RateLimitConfig{
+		{Algorithm: "fixed-window", Limit: 1, Window: time.Minute},
+		{Limit: 0, Window: time.Minute},
+		{Limit: 1, Window: 0},
+		{Limit: 1, Window: time.Microsecond},
+	} {
+		if _, err := MiddlewareRateLimit(cfg); err == nil {
+			t.Errorf("%+v expect error", cfg)
+		}
+	}
+}
+
+func TestRateLimiterCooldown(t *testing.T) {
+	servers := newTestRedis(t, "default")
+	ctx := context.Background()
+
+	cfg := RateLimitConfig{RedisName: "default", Limit: 10, Window: time.Minute, Cooldown: 100 * time.Millisecond}
+	newLimiter := func() *rateLimiter {
+		return &rateLimiter{cfg: cfg, id: utils.UUID(), local: newLocalLimiter(cfg.Limit, cfg.Window)}
+	}
+
+	// 多个实例共用key时计数不丢失
+	a, b := newLimiter(), newLimiter()
+	for i := 0; i < 2; i++ {
+		a.allow(ctx, "shared")
+		b.allow(ctx, "shared")
+	}
+	if n, _ := servers["default"].ZMembers("shared"); len(n) != 4 {
+		t.Fatalf("shared key members %d", len(n))
+	}
+
+	// redis恢复后cooldown内继续使用进程内限流
+	servers["default"].Close()
+	a.allow(ctx, "cooldown")
+	servers["default"].Restart()
+
+	a.allow(ctx, "cooldown")
+	if servers["default"].Exists("cooldown") {
+		t.Fatal("redis used during cooldown")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	a.allow(ctx, "cooldown")
+	if !servers["default"].Exists("cooldown") {
+		t.Fatal("redis not used after cooldown")
+	}
+}
@@ -2,9 +2,14 @@ package shiba
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"sync"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -17,21 +22,171 @@ func init() {
 	registerModule(-98, redisx)
 }
 
+// redis部署模式
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeCluster    = "cluster"
+	RedisModeSentinel   = "sentinel"
+)
+
 type redisConfig struct {
-	Disable      bool     `yaml:"disable"`
-	IsCluster    bool     `yaml:"isCluster"` // 是否是集群
-	Address      []string `yaml:"address"`   // 大于1个地址为集群
-	DBIndex      int      `yaml:"dbIndex"`
-	Password     string   `yaml:"password"`
-	PoolSize     int      `yaml:"poolSize"`
-	MinIdleConns int      `yaml:"minIdleConns"`
+	Disable          bool     `yaml:"disable"`
+	Mode             string   `yaml:"mode"`             // standalone cluster sentinel 为空时根据isCluster判断
+	IsCluster        bool     `yaml:"isCluster"`        // 是否是集群，等同于mode: cluster
+	Address          []string `yaml:"address"`          // standalone使用第一个地址，cluster为节点地址，sentinel为哨兵地址
+	MasterName       string   `yaml:"masterName"`       // sentinel主节点名称
+	SentinelPassword string   `yaml:"sentinelPassword"` // sentinel哨兵密码
+	DBIndex          int      `yaml:"dbIndex"`          // sentinel开启routeByLatency、routeRandomly时只能为0
+	Username         string   `yaml:"username"`         // ACL用户名，redis 6.0+
+	Password         string   `yaml:"password"`
+	PoolSize         int      `yaml:"poolSize"`
+	MinIdleConns     int      `yaml:"minIdleConns"`
+
+	// 超时和重试，为0时使用go-redis默认值
+	DialTimeout  time.Duration `yaml:"dialTimeout"`  // 默认5s
+	ReadTimeout  time.Duration `yaml:"readTimeout"`  // 默认3s，-1不超时
+	WriteTimeout time.Duration `yaml:"writeTimeout"` // 默认等于readTimeout
+	PoolTimeout  time.Duration `yaml:"poolTimeout"`  // 连接池没有空闲连接时的等待时间，默认readTimeout+1s
+	IdleTimeout  time.Duration `yaml:"idleTimeout"`  // 空闲连接关闭时间，默认5m，-1不关闭
+	MaxRetries   int           `yaml:"maxRetries"`   // 命令失败最大重试次数，默认3，-1不重试
+
+	TLS redisTLSConfig `yaml:"tls"`
+
+	// 从节点读取
+	// cluster：readOnly开启后只读命令可以发往从节点，routeByLatency、routeRandomly选择节点的方式
+	// sentinel：routeByLatency、routeRandomly开启后只读命令按对应方式发往主从节点，
+	// replicaOnly开启后所有命令都发往从节点，适合只读的连接池
+	ReadOnly       bool `yaml:"readOnly"`
+	RouteByLatency bool `yaml:"routeByLatency"` // 只读命令发往延迟最低的节点
+	RouteRandomly  bool `yaml:"routeRandomly"`  // 只读命令随机发往节点
+	ReplicaOnly    bool `yaml:"replicaOnly"`
+}
+
+type redisTLSConfig struct {
+	Enable             bool   `yaml:"enable"`
+	CAFile             string `yaml:"caFile"`   // 为空时使用系统根证书
+	CertFile           string `yaml:"certFile"` // 客户端证书，服务端要求双向认证时配置
+	KeyFile            string `yaml:"keyFile"`
+	ServerName         string `yaml:"serverName"` // 为空时使用连接地址中的主机名
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+func (cfg redisTLSConfig) tlsConfig() (*tls.Config, error) {
+	if !cfg.Enable {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		ca, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificate found in caFile:" + cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
+
+// universalOptions 所有模式共用的选项
+func (cfg redisConfig) universalOptions() (*redis.UniversalOptions, error) {
+	tlsCfg, err := cfg.TLS.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("tls:%w", err)
+	}
+
+	return &redis.UniversalOptions{
+		Addrs:            cfg.Address,
+		DB:               cfg.DBIndex,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		SentinelPassword: cfg.SentinelPassword,
+		MaxRetries:       cfg.MaxRetries,
+		DialTimeout:      cfg.DialTimeout,
+		ReadTimeout:      cfg.ReadTimeout,
+		WriteTimeout:     cfg.WriteTimeout,
+		PoolSize:         cfg.PoolSize,
+		MinIdleConns:     cfg.MinIdleConns,
+		PoolTimeout:      cfg.PoolTimeout,
+		IdleTimeout:      cfg.IdleTimeout,
+		TLSConfig:        tlsCfg,
+		// 默认不访问从节点，和MinIdleConns为0结合，间接避免从节点建立连接与访问
+		ReadOnly:       cfg.ReadOnly,
+		RouteByLatency: cfg.RouteByLatency,
+		RouteRandomly:  cfg.RouteRandomly,
+		MasterName:     cfg.MasterName,
+	}, nil
+}
+
+// client 按部署模式创建客户端，不检查连接
+func (cfg redisConfig) client(opt *redis.UniversalOptions) (RedisCmdable, error) {
+	switch cfg.mode() {
+	case RedisModeStandalone:
+		return redis.NewClient(opt.Simple()), nil
+	case RedisModeCluster:
+		return redis.NewClusterClient(opt.Cluster()), nil
+	case RedisModeSentinel:
+		if cfg.MasterName == "" {
+			return nil, errors.New("masterName is empty")
+		}
+
+		// 只读命令路由到从节点需要使用集群客户端，不支持select db
+		if cfg.RouteByLatency || cfg.RouteRandomly {
+			if cfg.DBIndex != 0 {
+				return nil, errors.New("dbIndex must be 0 with routeByLatency or routeRandomly in sentinel mode")
+			}
+			return redis.NewFailoverClusterClient(cfg.failoverOptions(opt)), nil
+		}
+		return redis.NewFailoverClient(cfg.failoverOptions(opt)), nil
+	}
+
+	return nil, errors.New("unsupported mode:" + cfg.Mode)
+}
+
+// failoverOptions sentinel模式的选项，UniversalOptions.Failover不会设置从节点路由
+func (cfg redisConfig) failoverOptions(opt *redis.UniversalOptions) *redis.FailoverOptions {
+	failoverOpt := opt.Failover()
+	failoverOpt.RouteByLatency = cfg.RouteByLatency
+	failoverOpt.RouteRandomly = cfg.RouteRandomly
+	failoverOpt.SlaveOnly = cfg.ReplicaOnly
+	return failoverOpt
+}
+
+func (cfg redisConfig) mode() string {
+	if cfg.Mode != "" {
+		return cfg.Mode
+	}
+
+	if cfg.IsCluster {
+		return RedisModeCluster
+	}
+
+	return RedisModeStandalone
 }
 
 var redisx = &redisPool{}
 
 type redisPool struct {
 	Config  map[string]redisConfig `yaml:"redis"`
-	poolsMu sync.Mutex
+	poolsMu sync.RWMutex           // 限流、锁等在请求中调用Get，已建立的连接池只加读锁
 	pools   map[string]redis.Cmdable
 }
 
@@ -68,11 +223,7 @@ func (p *redisPool) testAll() error {
 			return fmt.Errorf(name+":%w", err)
 		}
 
-		if client, ok := pool.(*redis.ClusterClient); ok {
-			if err := client.Close(); err != nil {
-				return fmt.Errorf(name+":%w", err)
-			}
-		} else if client, ok := pool.(*redis.Client); ok {
+		if client, ok := pool.(io.Closer); ok {
 			if err := client.Close(); err != nil {
 				return fmt.Errorf(name+":%w", err)
 			}
@@ -83,16 +234,15 @@ func (p *redisPool) testAll() error {
 }
 
 func (p *redisPool) Stop() error {
+	p.poolsMu.Lock()
+	defer p.poolsMu.Unlock()
+
 	for name, pool := range p.pools {
 		if pool == nil {
 			continue
 		}
 
-		if client, ok := pool.(*redis.ClusterClient); ok {
-			if err := client.Close(); err != nil {
-				return fmt.Errorf(name+":%w", err)
-			}
-		} else if client, ok := pool.(*redis.Client); ok {
+		if client, ok := pool.(io.Closer); ok {
 			if err := client.Close(); err != nil {
 				return fmt.Errorf(name+":%w", err)
 			}
@@ -107,7 +257,9 @@ func (p *redisPool) Get(name string) (RedisCmdable, error) {
 		name = "default"
 	}
 
+	p.poolsMu.RLock()
 	pool, ok := p.pools[name]
+	p.poolsMu.RUnlock()
 	if ok {
 		return pool, nil
 	}
@@ -144,37 +296,27 @@ func (p *redisPool) new(name string, cfg redisConfig) (RedisCmdable, error) {
 		return nil, errors.New(name + ":address is empty")
 	}
 
-	var client RedisCmdable
-	if cfg.IsCluster {
-		client = redis.NewClusterClient(&redis.ClusterOptions{
-			Addrs:        cfg.Address,
-			PoolSize:     cfg.PoolSize,
-			Password:     cfg.Password,
-			MinIdleConns: cfg.MinIdleConns,
-			// 避免访问从节点，和MinIdleConns为0结合，间接避免从节点建立连接与访问
-			ReadOnly:       false,
-			RouteByLatency: false,
-			RouteRandomly:  false,
-			//Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			//	var d net.Dialer
-			//	return d.DialContext(ctx, network, addr)
-			//},
-		})
-	} else {
-		client = redis.NewClient(&redis.Options{
-			Addr:         cfg.Address[0],
-			DB:           cfg.DBIndex,
-			PoolSize:     cfg.PoolSize,
-			MinIdleConns: cfg.MinIdleConns,
-			Password:     cfg.Password,
-		})
-
-	}
-
-	_, err := client.Ping(context.Background()).Result()
+	opt, err := cfg.universalOptions()
+	if err != nil {
+		return nil, fmt.Errorf(name+":%w", err)
+	}
+
+	client, err := cfg.client(opt)
 	if err != nil {
 		return nil, fmt.Errorf(name+":%w", err)
 	}
 
+	_, err = client.Ping(context.Background()).Result()
+	if err != nil {
+		if closer, ok := client.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, fmt.Errorf(name+":%w", err)
+	}
+
+	if hookable, ok := client.(interface{ AddHook(redis.Hook) }); ok {
+		hookable.AddHook(redisHook{name: name})
+	}
+
 	return client, nil
 }
@@ -0,0 +1,146 @@
+package shiba
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(redisCmdDuration, redisCmdErrors, &redisStatsCollector{pool: redisx})
+}
+
+var (
+	redisCmdDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "shiba_redis_command_duration_seconds",
+		Help:    "Latency of redis commands.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"name", "command"})
+	redisCmdErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shiba_redis_command_errors_total",
+		Help: "The total number of failed redis commands, redis.Nil is not counted.",
+	}, []string{"name", "command"})
+
+	redisStatsLabels = []string{"name"}
+
+	redisHitsDesc = prometheus.NewDesc("shiba_redis_pool_hits_total",
+		"The number of times a free connection was found in the pool.", redisStatsLabels, nil)
+	redisMissesDesc = prometheus.NewDesc("shiba_redis_pool_misses_total",
+		"The number of times a free connection was not found in the pool.", redisStatsLabels, nil)
+	redisTimeoutsDesc = prometheus.NewDesc("shiba_redis_pool_timeouts_total",
+		"The number of times a wait timeout occurred.", redisStatsLabels, nil)
+	redisTotalConnsDesc = prometheus.NewDesc("shiba_redis_pool_total_connections",
+		"The number of total connections in the pool.", redisStatsLabels, nil)
+	redisIdleConnsDesc = prometheus.NewDesc("shiba_redis_pool_idle_connections",
+		"The number of idle connections in the pool.", redisStatsLabels, nil)
+	redisStaleConnsDesc = prometheus.NewDesc("shiba_redis_pool_stale_connections_total",
+		"The number of stale connections removed from the pool.", redisStatsLabels, nil)
+)
+
+type (
+	redisHookStartKey struct{}
+	redisHookSpanKey  struct{}
+)
+
+// redisHook 记录每个命令的耗时、错误，调用方ctx中有span时创建子span
+type redisHook struct {
+	name string
+}
+
+func (h redisHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return h.before(ctx, cmd.Name()), nil
+}
+
+func (h redisHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.after(ctx, cmd.Name(), cmd.Err())
+	return nil
+}
+
+func (h redisHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return h.before(ctx, "pipeline"), nil
+}
+
+func (h redisHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if cmdErr := cmd.Err(); cmdErr != nil && !errors.Is(cmdErr, redis.Nil) {
+			err = cmdErr
+			break
+		}
+	}
+
+	h.after(ctx, "pipeline", err)
+	return nil
+}
+
+func (h redisHook) before(ctx context.Context, command string) context.Context {
+	if parent := opentracing.SpanFromContext(ctx); parent != nil {
+		span := parent.Tracer().StartSpan("redis "+command, opentracing.ChildOf(parent.Context()))
+		ext.SpanKindRPCClient.Set(span)
+		ext.DBType.Set(span, "redis")
+		ext.DBInstance.Set(span, h.name)
+		// 只记录命令名，参数中可能有敏感数据
+		ext.DBStatement.Set(span, command)
+		ctx = context.WithValue(opentracing.ContextWithSpan(ctx, span), redisHookSpanKey{}, span)
+	}
+
+	return context.WithValue(ctx, redisHookStartKey{}, time.Now())
+}
+
+func (h redisHook) after(ctx context.Context, command string, err error) {
+	if start, ok := ctx.Value(redisHookStartKey{}).(time.Time); ok {
+		redisCmdDuration.WithLabelValues(h.name, command).Observe(time.Since(start).Seconds())
+	}
+
+	failed := err != nil && !errors.Is(err, redis.Nil)
+	if failed {
+		redisCmdErrors.WithLabelValues(h.name, command).Inc()
+	}
+
+	// 只结束before中创建的span，调用方的span由调用方结束
+	if span, ok := ctx.Value(redisHookSpanKey{}).(opentracing.Span); ok {
+		if failed {
+			ext.LogError(span, err)
+		}
+		span.Finish()
+	}
+}
+
+// redisStatsCollector 采集时读取每个连接池的redis.PoolStats
+type redisStatsCollector struct {
+	pool *redisPool
+}
+
+func (c *redisStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- redisHitsDesc
+	ch <- redisMissesDesc
+	ch <- redisTimeoutsDesc
+	ch <- redisTotalConnsDesc
+	ch <- redisIdleConnsDesc
+	ch <- redisStaleConnsDesc
+}
+
+func (c *redisStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.pool.poolsMu.RLock()
+	defer c.pool.poolsMu.RUnlock()
+
+	for name, pool := range c.pool.pools {
+		client, ok := pool.(interface{ PoolStats() *redis.PoolStats })
+		if !ok {
+			continue
+		}
+
+		stats := client.PoolStats()
+		ch <- prometheus.MustNewConstMetric(redisHitsDesc, prometheus.CounterValue, float64(stats.Hits), name)
+		ch <- prometheus.MustNewConstMetric(redisMissesDesc, prometheus.CounterValue, float64(stats.Misses), name)
+		ch <- prometheus.MustNewConstMetric(redisTimeoutsDesc, prometheus.CounterValue, float64(stats.Timeouts), name)
+		ch <- prometheus.MustNewConstMetric(redisTotalConnsDesc, prometheus.GaugeValue, float64(stats.TotalConns), name)
+		ch <- prometheus.MustNewConstMetric(redisIdleConnsDesc, prometheus.GaugeValue, float64(stats.IdleConns), name)
+		ch <- prometheus.MustNewConstMetric(redisStaleConnsDesc, prometheus.CounterValue, float64(stats.StaleConns), name)
+	}
+}
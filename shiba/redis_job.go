@@ -0,0 +1,637 @@
+package shiba
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/windzhu0514/shiba/log"
+	"github.com/windzhu0514/shiba/utils"
+)
+
+// 基于redis有序集合的延时任务队列，任务保存在redis中，服务重启不丢失
+// 任务按名称注册处理函数，执行失败按指数退避重试，超过最大重试次数转入死信列表
+// 任务执行超过visibilityTimeout未完成时（实例崩溃等）重新进入队列
+//
+//	jobQueue:
+//	  redis: default
+//	  concurrency: 10
+//
+//	shiba.RegisterJob("sendMail", func(ctx context.Context, mail Mail) error {
+//		return nil
+//	})
+//	shiba.EnqueueJobIn(ctx, "sendMail", mail, 10*time.Minute, shiba.JobUnique(mail.ID))
+
+func init() {
+	registerModule(-96, jobs)
+	prometheus.MustRegister(jobProcessed, jobDuration, &jobQueueCollector{queue: jobs})
+}
+
+// ErrJobDuplicate 唯一任务已存在，返回的id为已存在的任务id
+var ErrJobDuplicate = errors.New("job is duplicate")
+
+var (
+	jobProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "shiba_job_processed_total",
+		Help: "The total number of processed jobs, result is success, retry or dead.",
+	}, []string{"name", "result"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "shiba_job_duration_seconds",
+		Help: "Job handler execution time.",
+	}, []string{"name"})
+
+	jobQueueDepthDesc = prometheus.NewDesc("shiba_job_queue_depth",
+		"The number of jobs in the queue, state is scheduled, ready, processing or dead.", []string{"state"}, nil)
+)
+
+var (
+	jobEnqueueScript = redis.NewScript(`
+if KEYS[3] then
+	if not redis.call("SET", KEYS[3], ARGV[1], "NX", "PX", ARGV[4]) then
+		return redis.call("GET", KEYS[3])
+	end
+end
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+redis.call("ZADD", KEYS[1], ARGV[3], ARGV[1])
+return ARGV[1]`)
+
+	jobFetchScript = redis.NewScript(`
+local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 1)
+if #ids == 0 then
+	return false
+end
+local id = ids[1]
+redis.call("ZREM", KEYS[1], id)
+local job = redis.call("HGET", KEYS[3], id)
+if not job then
+	redis.call("HDEL", KEYS[4], id)
+	return {id, "", 0}
+end
+redis.call("ZADD", KEYS[2], ARGV[2], id)
+return {id, job, redis.call("HINCRBY", KEYS[4], id, 1)}`)
+
+	// 超过可见时间的任务重新进入队列
+	jobRequeueScript = redis.NewScript(`
+local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 100)
+for _, id in ipairs(ids) do
+	redis.call("ZREM", KEYS[1], id)
+	redis.call("ZADD", KEYS[2], ARGV[1], id)
+end
+return #ids`)
+
+	jobRetryScript = redis.NewScript(`
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 1 then
+	redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+end
+return 0`)
+
+	jobFinishScript = redis.NewScript(`
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("HDEL", KEYS[3], ARGV[1])
+redis.call("HDEL", KEYS[4], ARGV[1])
+if ARGV[2] ~= "" then
+	redis.call("LPUSH", KEYS[5], ARGV[2])
+	redis.call("LTRIM", KEYS[5], 0, tonumber(ARGV[3]) - 1)
+end
+if KEYS[6] and redis.call("GET", KEYS[6]) == ARGV[1] then
+	redis.call("DEL", KEYS[6])
+end
+return 0`)
+)
+
+type jobQueueConfig struct {
+	Disable           bool          `yaml:"disable"`
+	Redis             string        `yaml:"redis"`             // redis配置名，默认default
+	Queue             string        `yaml:"queue"`             // 队列名，作为redis key前缀，默认default
+	Concurrency       int           `yaml:"concurrency"`       // 并发执行数，默认1
+	PollInterval      time.Duration `yaml:"pollInterval"`      // 没有任务时的轮询间隔，默认1s
+	VisibilityTimeout time.Duration `yaml:"visibilityTimeout"` // 任务执行超时时间，超时后重新进入队列，默认5m
+	MaxRetries        int           `yaml:"maxRetries"`        // 默认最大重试次数，默认3，-1不重试
+	BackoffBase       time.Duration `yaml:"backoffBase"`       // 第一次重试间隔，之后每次翻倍，默认1s
+	BackoffMax        time.Duration `yaml:"backoffMax"`        // 最大重试间隔，默认1h
+	DeadLimit         int64         `yaml:"deadLimit"`         // 死信列表保留的任务数，默认1000
+	DrainTimeout      time.Duration `yaml:"drainTimeout"`      // 停止时等待执行中的任务完成的时间，超时后取消处理函数的ctx，默认30s
+}
+
+func (cfg jobQueueConfig) withDefault() jobQueueConfig {
+	if cfg.Redis == "" {
+		cfg.Redis = "default"
+	}
+	if cfg.Queue == "" {
+		cfg.Queue = "default"
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.VisibilityTimeout <= 0 {
+		cfg.VisibilityTimeout = 5 * time.Minute
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	} else if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.BackoffBase <= 0 {
+		cfg.BackoffBase = time.Second
+	}
+	if cfg.BackoffMax <= 0 {
+		cfg.BackoffMax = time.Hour
+	}
+	if cfg.DeadLimit <= 0 {
+		cfg.DeadLimit = 1000
+	}
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = 30 * time.Second
+	}
+
+	return cfg
+}
+
+// backoff 第attempts次执行失败后的重试间隔
+func (cfg jobQueueConfig) backoff(attempts int) time.Duration {
+	d := cfg.BackoffBase
+	for i := 1; i < attempts && d < cfg.BackoffMax; i++ {
+		d *= 2
+	}
+
+	if d > cfg.BackoffMax {
+		d = cfg.BackoffMax
+	}
+
+	return d
+}
+
+// jobKeys 使用{queue}作为hash tag，集群模式下lua脚本访问的key在同一个slot
+type jobKeys struct {
+	scheduled  string // 待执行 zset id->执行时间
+	processing string // 执行中 zset id->可见时间
+	jobs       string // 任务内容 hash id->job
+	attempts   string // 执行次数 hash id->次数
+	dead       string // 死信 list
+}
+
+func newJobKeys(queue string) jobKeys {
+	prefix := "shiba:job:{" + queue + "}:"
+	return jobKeys{
+		scheduled:  prefix + "scheduled",
+		processing: prefix + "processing",
+		jobs:       prefix + "jobs",
+		attempts:   prefix + "attempts",
+		dead:       prefix + "dead",
+	}
+}
+
+func (k jobKeys) unique(key string) string {
+	return k.jobs + ":unique:" + key
+}
+
+type job struct {
+	ID         string          `json:"id"`
+	Name       string          `json:"name"`
+	Payload    json.RawMessage `json:"payload"`
+	MaxRetries int             `json:"maxRetries"`
+	Unique     string          `json:"unique,omitempty"`
+	EnqueuedAt time.Time       `json:"enqueuedAt"`
+}
+
+// deadJob 死信列表中的任务
+type deadJob struct {
+	job
+	Attempts int64     `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+type jobHandler func(ctx context.Context, payload []byte) error
+
+type jobOptions struct {
+	maxRetries int
+	unique     bool
+	uniqueKey  string
+}
+
+type JobOption func(opts *jobOptions)
+
+// JobMaxRetries 覆盖配置中的最大重试次数
+func JobMaxRetries(n int) JobOption {
+	return func(opts *jobOptions) {
+		opts.maxRetries = n
+	}
+}
+
+// JobUnique 同名任务中key相同的任务在执行完成前只能存在一个，key为空时使用payload
+func JobUnique(key string) JobOption {
+	return func(opts *jobOptions) {
+		opts.unique = true
+		opts.uniqueKey = key
+	}
+}
+
+var jobs = &jobQueue{handlers: make(map[string]jobHandler)}
+
+// RegisterJob 注册任务处理函数，payload使用json编解码，需要在服务启动前调用
+func RegisterJob[T any](name string, handler func(ctx context.Context, payload T) error) {
+	registerJob(jobs, name, handler)
+}
+
+func registerJob[T any](q *jobQueue, name string, handler func(ctx context.Context, payload T) error) {
+	q.register(name, func(ctx context.Context, data []byte) error {
+		var payload T
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return fmt.Errorf("decode payload:%w", err)
+		}
+
+		return handler(ctx, payload)
+	})
+}
+
+// EnqueueJobAt 添加在at时间执行的任务，返回任务id
+func EnqueueJobAt(ctx context.Context, name string, payload interface{}, at time.Time, opts ...JobOption) (string, error) {
+	return jobs.enqueue(ctx, name, payload, at, opts...)
+}
+
+// EnqueueJobIn 添加delay后执行的任务，返回任务id
+func EnqueueJobIn(ctx context.Context, name string, payload interface{}, delay time.Duration, opts ...JobOption) (string, error) {
+	return jobs.enqueue(ctx, name, payload, time.Now().Add(delay), opts...)
+}
+
+type jobQueue struct {
+	Config jobQueueConfig `yaml:"jobQueue"`
+
+	handlersMu sync.RWMutex
+	handlers   map[string]jobHandler
+
+	cfg    jobQueueConfig // 补充默认值后的配置
+	connMu sync.RWMutex   // Start写入keys、client，采集指标和添加任务时读取
+	keys   jobKeys
+	client RedisCmdable
+	log    log.Logger
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// 处理函数的ctx，停止时超过drainTimeout取消
+	handleCtx    context.Context
+	cancelHandle context.CancelFunc
+}
+
+func (q *jobQueue) Name() string {
+	return "jobQueue"
+}
+
+func (q *jobQueue) Init() error {
+	return nil
+}
+
+func (q *jobQueue) register(name string, handler jobHandler) {
+	q.handlersMu.Lock()
+	defer q.handlersMu.Unlock()
+
+	if _, ok := q.handlers[name]; ok {
+		panic("job " + name + " is alreadly registered")
+	}
+
+	q.handlers[name] = handler
+}
+
+func (q *jobQueue) handler(name string) jobHandler {
+	q.handlersMu.RLock()
+	defer q.handlersMu.RUnlock()
+
+	return q.handlers[name]
+}
+
+func (q *jobQueue) Start() error {
+	if _, ok := fileCfg[q.Name()]; !ok {
+		defaultLogger.Clone("jobQueue").Debug("has no jobQueue config,the module will not initialize")
+		return nil
+	}
+
+	if q.Config.Disable {
+		return nil
+	}
+
+	q.cfg = q.Config.withDefault()
+	q.log = defaultLogger.Clone("jobQueue")
+
+	client, err := redisx.Get(q.cfg.Redis)
+	if err != nil {
+		return err
+	}
+
+	q.connMu.Lock()
+	q.keys = newJobKeys(q.cfg.Queue)
+	q.client = client
+	q.connMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	q.handleCtx, q.cancelHandle = context.WithCancel(context.Background())
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.requeueLoop(ctx)
+	}()
+
+	for i := 0; i < q.cfg.Concurrency; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			q.workLoop(ctx)
+		}()
+	}
+
+	return nil
+}
+
+// Stop 停止获取新任务，等待执行中的任务完成，超过drainTimeout取消处理函数的ctx
+func (q *jobQueue) Stop() error {
+	if q.cancel == nil {
+		return nil
+	}
+
+	q.cancel()
+	timer := time.AfterFunc(q.cfg.DrainTimeout, func() {
+		q.log.Warnf("drain timeout after %s, cancel running jobs", q.cfg.DrainTimeout)
+		q.cancelHandle()
+	})
+	q.wg.Wait()
+	timer.Stop()
+	q.cancelHandle()
+
+	return nil
+}
+
+// conn 返回Start设置的redis客户端和key，未启动时client为nil
+func (q *jobQueue) conn() (RedisCmdable, jobKeys) {
+	q.connMu.RLock()
+	defer q.connMu.RUnlock()
+
+	return q.client, q.keys
+}
+
+func (q *jobQueue) enqueue(ctx context.Context, name string, payload interface{}, at time.Time, opts ...JobOption) (string, error) {
+	client, qk := q.conn()
+	if client == nil {
+		return "", errors.New("jobQueue is not started")
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("encode payload:%w", err)
+	}
+
+	options := jobOptions{maxRetries: q.cfg.MaxRetries}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	j := job{
+		ID:         utils.UUID(),
+		Name:       name,
+		Payload:    data,
+		MaxRetries: options.maxRetries,
+		EnqueuedAt: time.Now(),
+	}
+
+	keys := []string{qk.scheduled, qk.jobs}
+	var uniqueTTL time.Duration
+	if options.unique {
+		key := options.uniqueKey
+		if key == "" {
+			sum := sha1.Sum(data)
+			key = hex.EncodeToString(sum[:])
+		}
+		j.Unique = qk.unique(name + ":" + key)
+		keys = append(keys, j.Unique)
+
+		// 任务完成时删除，过期时间防止任务丢失后无法再添加
+		uniqueTTL = time.Until(at) + 24*time.Hour
+		if uniqueTTL < 24*time.Hour {
+			uniqueTTL = 24 * time.Hour
+		}
+	}
+
+	value, err := json.Marshal(j)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := jobEnqueueScript.Run(ctx, client, keys,
+		j.ID, value, at.UnixNano()/int64(time.Millisecond), uniqueTTL.Milliseconds()).Text()
+	if err != nil {
+		return "", err
+	}
+
+	if id != j.ID {
+		return id, ErrJobDuplicate
+	}
+
+	return id, nil
+}
+
+func (q *jobQueue) requeueLoop(ctx context.Context) {
+	ticker := time.NewTicker(q.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		client, keys := q.conn()
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		n, err := jobRequeueScript.Run(ctx, client, []string{keys.processing, keys.scheduled}, now).Int()
+		if err != nil {
+			if ctx.Err() == nil {
+				q.log.Errorf("requeue:%s", err.Error())
+			}
+			continue
+		}
+
+		if n > 0 {
+			q.log.Warnf("%d jobs exceed visibility timeout, requeued", n)
+		}
+	}
+}
+
+func (q *jobQueue) workLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		ok, err := q.fetchAndRun(ctx)
+		if err != nil && ctx.Err() == nil {
+			q.log.Errorf("fetch job:%s", err.Error())
+		}
+
+		if !ok {
+			sleepContext(ctx, q.cfg.PollInterval)
+		}
+	}
+}
+
+// fetchAndRun 获取并执行一个到期任务，没有任务时返回false
+func (q *jobQueue) fetchAndRun(ctx context.Context) (bool, error) {
+	client, keys := q.conn()
+	now := time.Now()
+	deadline := now.Add(q.cfg.VisibilityTimeout)
+	result, err := jobFetchScript.Run(ctx, client,
+		[]string{keys.scheduled, keys.processing, keys.jobs, keys.attempts},
+		now.UnixNano()/int64(time.Millisecond), deadline.UnixNano()/int64(time.Millisecond)).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 3 {
+		return false, errors.New("unexpected fetch result")
+	}
+
+	id, _ := values[0].(string)
+	data, _ := values[1].(string)
+	attempts, _ := values[2].(int64)
+	if data == "" {
+		q.log.Warnf("job %s has no content, dropped", id)
+		return true, nil
+	}
+
+	var j job
+	if err := json.Unmarshal([]byte(data), &j); err != nil {
+		q.finish(job{ID: id}, attempts, fmt.Errorf("decode job:%w", err))
+		return true, nil
+	}
+
+	// 超过可见时间重新入队的任务(实例崩溃等)没有经过重试判断，执行次数用尽时转入死信列表
+	if attempts > int64(j.MaxRetries)+1 {
+		q.finish(j, attempts-1, errors.New("visibility timeout exceeded"))
+		return true, nil
+	}
+
+	q.run(j, attempts, deadline)
+	return true, nil
+}
+
+func (q *jobQueue) run(j job, attempts int64, deadline time.Time) {
+	// 执行超过可见时间后任务会被重新投递，处理函数应在ctx结束时返回
+	ctx, cancel := context.WithDeadline(q.handleCtx, deadline)
+	defer cancel()
+
+	start := time.Now()
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic:%v", r)
+			}
+		}()
+
+		handler := q.handler(j.Name)
+		if handler == nil {
+			return errors.New("cant find job handler:" + j.Name)
+		}
+
+		return handler(ctx, j.Payload)
+	}()
+	jobDuration.WithLabelValues(j.Name).Observe(time.Since(start).Seconds())
+
+	client, keys := q.conn()
+
+	// 停止时被取消的任务立即重新入队，不转入死信列表
+	if err != nil && q.handleCtx.Err() != nil {
+		q.log.Warnf("job %s %s canceled by stop, requeued", j.Name, j.ID)
+		err = jobRetryScript.Run(context.Background(), client, []string{keys.processing, keys.scheduled},
+			j.ID, time.Now().UnixNano()/int64(time.Millisecond)).Err()
+		if err != nil {
+			q.log.Errorf("requeue job %s:%s", j.ID, err.Error())
+		}
+		return
+	}
+
+	if err != nil && attempts <= int64(j.MaxRetries) {
+		retryAt := time.Now().Add(q.cfg.backoff(int(attempts)))
+		q.log.Warnf("job %s %s attempt %d:%s, retry at %s", j.Name, j.ID, attempts, err.Error(), retryAt.Format(time.RFC3339))
+		jobProcessed.WithLabelValues(j.Name, "retry").Inc()
+
+		err = jobRetryScript.Run(context.Background(), client, []string{keys.processing, keys.scheduled},
+			j.ID, retryAt.UnixNano()/int64(time.Millisecond)).Err()
+		if err != nil {
+			q.log.Errorf("retry job %s:%s", j.ID, err.Error())
+		}
+		return
+	}
+
+	q.finish(j, attempts, err)
+}
+
+// finish 任务成功或重试次数用尽，err不为nil时写入死信列表
+func (q *jobQueue) finish(j job, attempts int64, err error) {
+	var dead []byte
+	if err != nil {
+		q.log.Errorf("job %s %s failed after %d attempts:%s", j.Name, j.ID, attempts, err.Error())
+		jobProcessed.WithLabelValues(j.Name, "dead").Inc()
+
+		dead, _ = json.Marshal(deadJob{job: j, Attempts: attempts, Error: err.Error(), FailedAt: time.Now()})
+	} else {
+		jobProcessed.WithLabelValues(j.Name, "success").Inc()
+	}
+
+	client, qk := q.conn()
+	keys := []string{qk.processing, qk.scheduled, qk.jobs, qk.attempts, qk.dead}
+	if j.Unique != "" {
+		keys = append(keys, j.Unique)
+	}
+
+	err = jobFinishScript.Run(context.Background(), client, keys, j.ID, string(dead), q.cfg.DeadLimit).Err()
+	if err != nil {
+		q.log.Errorf("finish job %s:%s", j.ID, err.Error())
+	}
+}
+
+// jobQueueCollector 采集时从redis读取队列长度
+type jobQueueCollector struct {
+	queue *jobQueue
+}
+
+func (c *jobQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- jobQueueDepthDesc
+}
+
+func (c *jobQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	client, keys := c.queue.conn()
+	if client == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	now := fmt.Sprint(time.Now().UnixNano() / int64(time.Millisecond))
+	pipe := client.Pipeline()
+	scheduled := pipe.ZCard(ctx, keys.scheduled)
+	ready := pipe.ZCount(ctx, keys.scheduled, "-inf", now)
+	processing := pipe.ZCard(ctx, keys.processing)
+	dead := pipe.LLen(ctx, keys.dead)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return
+	}
+
+	// scheduled zset中包含已到执行时间的任务，scheduled只统计未到执行时间的
+	ch <- prometheus.MustNewConstMetric(jobQueueDepthDesc, prometheus.GaugeValue, float64(scheduled.Val()-ready.Val()), "scheduled")
+	ch <- prometheus.MustNewConstMetric(jobQueueDepthDesc, prometheus.GaugeValue, float64(ready.Val()), "ready")
+	ch <- prometheus.MustNewConstMetric(jobQueueDepthDesc, prometheus.GaugeValue, float64(processing.Val()), "processing")
+	ch <- prometheus.MustNewConstMetric(jobQueueDepthDesc, prometheus.GaugeValue, float64(dead.Val()), "dead")
+}
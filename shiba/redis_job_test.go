@@ -0,0 +1,250 @@
+package shiba
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/yaml.v3"
+)
+
+type testMail struct {
+	To string `json:"to"`
+}
+
+func TestJobQueue(t *testing.T) {
+	servers := newTestRedis(t, "default")
+	fileCfg["jobQueue"] = yaml.Node{}
+	defer delete(fileCfg, "jobQueue")
+
+	q := &jobQueue{
+		Config: jobQueueConfig{
+			Concurrency:  2,
+			PollInterval: 10 * time.Millisecond,
+			MaxRetries:   1,
+			BackoffBase:  10 * time.Millisecond,
+		},
+		handlers: make(map[string]jobHandler),
+	}
+
+	var sent int32
+	var sentTo atomic.Value
+	registerJob(q, "sendMail", func(ctx context.Context, mail testMail) error {
+		sentTo.Store(mail.To)
+		atomic.AddInt32(&sent, 1)
+		return nil
+	})
+	var failed int32
+	registerJob(q, "alwaysFail", func(ctx context.Context, payload int) error {
+		atomic.AddInt32(&failed, 1)
+		return errors.New("fail")
+	})
+
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Stop()
+
+	ctx := context.Background()
+	start := time.Now()
+	id, err := q.enqueue(ctx, "sendMail", testMail{To: "a@b.c"}, start.Add(100*time.Millisecond), JobUnique("a@b.c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dupID, err := q.enqueue(ctx, "sendMail", testMail{To: "a@b.c"}, start, JobUnique("a@b.c"))
+	if !errors.Is(err, ErrJobDuplicate) || dupID != id {
+		t.Fatalf("expect duplicate of %s, got %s %v", id, dupID, err)
+	}
+	if _, err := q.enqueue(ctx, "alwaysFail", 1, start); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&sent) == 0 || !servers["default"].Exists(q.keys.dead) {
+		if time.Now().After(deadline) {
+			t.Fatal("jobs not processed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatal("delayed job executed too early")
+	}
+	if sentTo.Load() != "a@b.c" {
+		t.Fatalf("unexpected payload %v", sentTo.Load())
+	}
+	if n := atomic.LoadInt32(&failed); n != 2 {
+		t.Fatalf("failed job executed %d times", n)
+	}
+
+	// 完成后唯一key释放，可以再次添加
+	for {
+		_, err := q.enqueue(ctx, "sendMail", testMail{To: "a@b.c"}, time.Now(), JobUnique("a@b.c"))
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrJobDuplicate) || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobBackoff(t *testing.T) {
+	cfg := jobQueueConfig{BackoffBase: time.Second, BackoffMax: 5 * time.Second}
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second} {
+		if got := cfg.backoff(attempts); got != want {
+			t.Fatalf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestJobQueueCollector(t *testing.T) {
+	newTestRedis(t, "default")
+	client, _ := redisx.Get("default")
+
+	q := &jobQueue{}
+	collector := &jobQueueCollector{queue: q}
+	if n := testutil.CollectAndCount(collector); n != 0 {
+		t.Fatalf("not started: %d metrics", n)
+	}
+
+	q.connMu.Lock()
+	q.client = client
+	q.keys = newJobKeys("collector")
+	q.connMu.Unlock()
+
+	ctx := context.Background()
+	now := time.Now()
+	client.ZAdd(ctx, q.keys.scheduled,
+		&redis.Z{Score: float64(now.Add(-time.Minute).UnixNano() / int64(time.Millisecond)), Member: "ready"},
+		&redis.Z{Score: float64(now.Add(time.Hour).UnixNano() / int64(time.Millisecond)), Member: "later"},
+		&redis.Z{Score: float64(now.Add(2*time.Hour).UnixNano() / int64(time.Millisecond)), Member: "later2"},
+	)
+
+	expected := `
+# HELP shiba_job_queue_depth The number of jobs in the queue, state is scheduled, ready, processing or dead.
+# TYPE shiba_job_queue_depth gauge
+shiba_job_queue_depth{state="dead"} 0
+shiba_job_queue_depth{state="processing"} 0
+shiba_job_queue_depth{state="ready"} 1
+shiba_job_queue_depth{state="scheduled"} 2
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJobQueueStop(t *testing.T) {
+	servers := newTestRedis(t, "default")
+	fileCfg["jobQueue"] = yaml.Node{}
+	defer delete(fileCfg, "jobQueue")
+
+	q := &jobQueue{
+		Config: jobQueueConfig{
+			PollInterval: 10 * time.Millisecond,
+			DrainTimeout: 100 * time.Millisecond,
+		},
+		handlers: make(map[string]jobHandler),
+	}
+
+	started := make(chan struct{}, 1)
+	registerJob(q, "block", func(ctx context.Context, payload int) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.enqueue(context.Background(), "block", 1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job not started")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		q.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop blocked by running job")
+	}
+
+	// 被取消的任务重新入队，不进入死信列表
+	if n, _ := servers["default"].ZMembers(q.keys.scheduled); len(n) != 1 {
+		t.Fatalf("scheduled %v", n)
+	}
+	if servers["default"].Exists(q.keys.dead) {
+		t.Fatal("canceled job dead-lettered")
+	}
+}
+
+func TestJobQueueRequeuedExhausted(t *testing.T) {
+	servers := newTestRedis(t, "default")
+	client, _ := redisx.Get("default")
+
+	q := &jobQueue{
+		cfg:    jobQueueConfig{}.withDefault(),
+		keys:   newJobKeys("exhausted"),
+		client: client,
+		log:    defaultLogger,
+	}
+
+	// 实例崩溃后重新入队，已经执行了MaxRetries+1次
+	ctx := context.Background()
+	value, _ := json.Marshal(job{ID: "1", Name: "crash", MaxRetries: 1})
+	client.HSet(ctx, q.keys.jobs, "1", value)
+	client.HSet(ctx, q.keys.attempts, "1", 2)
+	client.ZAdd(ctx, q.keys.scheduled, &redis.Z{Score: 0, Member: "1"})
+
+	if ok, err := q.fetchAndRun(ctx); !ok || err != nil {
+		t.Fatalf("fetch %v %v", ok, err)
+	}
+
+	dead, _ := servers["default"].List(q.keys.dead)
+	if len(dead) != 1 || !strings.Contains(dead[0], "visibility timeout") {
+		t.Fatalf("dead %v", dead)
+	}
+}
+
+func TestJobQueueMissingContent(t *testing.T) {
+	servers := newTestRedis(t, "default")
+	client, _ := redisx.Get("default")
+
+	q := &jobQueue{
+		cfg:    jobQueueConfig{}.withDefault(),
+		keys:   newJobKeys("missing"),
+		client: client,
+		log:    defaultLogger,
+	}
+
+	// 任务内容丢失，执行次数也要删除
+	ctx := context.Background()
+	client.HSet(ctx, q.keys.attempts, "1", 1)
+	client.ZAdd(ctx, q.keys.scheduled, &redis.Z{Score: 0, Member: "1"})
+
+	if ok, err := q.fetchAndRun(ctx); !ok || err != nil {
+		t.Fatalf("fetch %v %v", ok, err)
+	}
+
+	if servers["default"].Exists(q.keys.attempts) || servers["default"].Exists(q.keys.scheduled) ||
+		servers["default"].Exists(q.keys.processing) {
+		t.Fatal("missing job not cleaned up")
+	}
+}
@@ -0,0 +1,284 @@
+package shiba
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 基于redis的分布式锁
+// 获取锁使用SET NX PX，锁的值为随机token，释放和续期时通过lua脚本校验token，避免误删其他持有者的锁
+// 持有期间每ttl/3自动续期，续期失败（锁已过期被其他实例获取）时关闭Lost()
+//
+//	lock, err := shiba.Lock(ctx, "default", "job:sync", 10*time.Second)
+//	if err != nil {
+//		return err
+//	}
+//	defer lock.Unlock(context.Background())
+
+var (
+	ErrLockNotAcquired = errors.New("lock not acquired")
+	ErrLockNotHeld     = errors.New("lock not held")
+)
+
+const lockRetryInterval = 50 * time.Millisecond
+
+var (
+	unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+	renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+)
+
+// RedisLock 已获取的锁
+type RedisLock struct {
+	key     string
+	token   string
+	ttl     time.Duration
+	clients []RedisCmdable
+	quorum  int
+
+	stopRenew context.CancelFunc
+	renewDone chan struct{}
+	lost      chan struct{}
+}
+
+func (l *RedisLock) Key() string {
+	return l.key
+}
+
+// Lost 续期失败时关闭，持有者应停止依赖锁的操作
+func (l *RedisLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Unlock 停止续期并释放锁，锁已过期时返回ErrLockNotHeld
+func (l *RedisLock) Unlock(ctx context.Context) error {
+	l.stopRenew()
+	<-l.renewDone
+
+	released := 0
+	var lastErr error
+	for _, client := range l.clients {
+		n, err := unlockScript.Run(ctx, client, []string{l.key}, l.token).Int()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		released += n
+	}
+
+	if released == 0 {
+		if lastErr != nil {
+			return lastErr
+		}
+		return ErrLockNotHeld
+	}
+
+	return nil
+}
+
+func (l *RedisLock) renewLoop(ctx context.Context) {
+	defer close(l.renewDone)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		renewed := 0
+		for _, client := range l.clients {
+			n, err := renewScript.Run(ctx, client, []string{l.key}, l.token, l.ttl.Milliseconds()).Int()
+			if err == nil && n == 1 {
+				renewed++
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if renewed < l.quorum {
+			defaultLogger.Clone("redis").Warnf("lock %s lost, renewed %d/%d", l.key, renewed, len(l.clients))
+			close(l.lost)
+			return
+		}
+	}
+}
+
+// acquireLock 在所有实例上尝试获取一次，成功数达到quorum且耗时小于有效期时成功，否则释放已获取的实例
+func acquireLock(ctx context.Context, clients []RedisCmdable, key string, ttl time.Duration) (*RedisLock, error) {
+	token, err := lockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	acquired := 0
+	var lastErr error
+	for _, client := range clients {
+		ok, err := client.SetNX(ctx, key, token, ttl).Result()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if ok {
+			acquired++
+		}
+	}
+
+	// 时钟漂移，参考redlock算法
+	drift := ttl/100 + 2*time.Millisecond
+	quorum := len(clients)/2 + 1
+	if acquired < quorum || time.Since(start)+drift >= ttl {
+		for _, client := range clients {
+			unlockScript.Run(context.Background(), client, []string{key}, token)
+		}
+
+		if lastErr != nil && acquired < quorum {
+			return nil, lastErr
+		}
+		return nil, ErrLockNotAcquired
+	}
+
+	renewCtx, stopRenew := context.WithCancel(context.Background())
+	l := &RedisLock{
+		key:       key,
+		token:     token,
+		ttl:       ttl,
+		clients:   clients,
+		quorum:    quorum,
+		stopRenew: stopRenew,
+		renewDone: make(chan struct{}),
+		lost:      make(chan struct{}),
+	}
+	go l.renewLoop(renewCtx)
+
+	return l, nil
+}
+
+func lockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func lockClients(redisNames []string) ([]RedisCmdable, error) {
+	if len(redisNames) == 0 {
+		return nil, errors.New("redisNames is empty")
+	}
+
+	clients := make([]RedisCmdable, len(redisNames))
+	for i, name := range redisNames {
+		client, err := redisx.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		clients[i] = client
+	}
+
+	return clients, nil
+}
+
+// minLockTTL 获取锁时要扣除ttl/100+2ms的时钟漂移，续期按毫秒设置过期时间，
+// ttl过小时加锁必然失败，PEXPIRE 0还会删除锁
+const minLockTTL = 10 * time.Millisecond
+
+// checkLockTTL ttl不能小于minLockTTL
+func checkLockTTL(ttl time.Duration) error {
+	if ttl < minLockTTL {
+		return fmt.Errorf("lock ttl must be at least %s", minLockTTL)
+	}
+
+	return nil
+}
+
+// lockWait 阻塞获取锁，直到成功或ctx结束
+func lockWait(ctx context.Context, clients []RedisCmdable, key string, ttl time.Duration) (*RedisLock, error) {
+	for {
+		l, err := acquireLock(ctx, clients, key, ttl)
+		if err == nil {
+			return l, nil
+		}
+
+		if !errors.Is(err, ErrLockNotAcquired) && ctx.Err() == nil {
+			defaultLogger.Clone("redis").Warnf("lock %s:%s", key, err.Error())
+		}
+
+		// 随机等待，避免多个实例同时重试
+		wait := lockRetryInterval/2 + time.Duration(mathrand.Int63n(int64(lockRetryInterval)))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("lock %s:%w", key, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// Lock 阻塞获取redisName上的锁，直到获取成功或ctx结束（使用context.WithTimeout设置等待时间）
+// 获取后自动续期，使用完调用Unlock释放
+func Lock(ctx context.Context, redisName, key string, ttl time.Duration) (*RedisLock, error) {
+	if err := checkLockTTL(ttl); err != nil {
+		return nil, err
+	}
+
+	clients, err := lockClients([]string{redisName})
+	if err != nil {
+		return nil, err
+	}
+
+	return lockWait(ctx, clients, key, ttl)
+}
+
+// TryLock 尝试获取一次锁，已被其他持有者获取时返回ErrLockNotAcquired
+func TryLock(ctx context.Context, redisName, key string, ttl time.Duration) (*RedisLock, error) {
+	if err := checkLockTTL(ttl); err != nil {
+		return nil, err
+	}
+
+	clients, err := lockClients([]string{redisName})
+	if err != nil {
+		return nil, err
+	}
+
+	return acquireLock(ctx, clients, key, ttl)
+}
+
+// Redlock 在多个相互独立的redis实例上获取锁，超过半数实例获取成功时成功
+// 阻塞直到获取成功或ctx结束
+func Redlock(ctx context.Context, redisNames []string, key string, ttl time.Duration) (*RedisLock, error) {
+	if err := checkLockTTL(ttl); err != nil {
+		return nil, err
+	}
+
+	clients, err := lockClients(redisNames)
+	if err != nil {
+		return nil, err
+	}
+
+	return lockWait(ctx, clients, key, ttl)
+}
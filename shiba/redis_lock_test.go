@@ -0,0 +1,100 @@
+package shiba
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	servers := newTestRedis(t, "default")
+	ctx := context.Background()
+
+	lock, err := Lock(ctx, "default", "lock:test", 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = TryLock(ctx, "default", "lock:test", time.Second); !errors.Is(err, ErrLockNotAcquired) {
+		t.Fatalf("TryLock err = %v, want ErrLockNotAcquired", err)
+	}
+
+	// 续期后超过ttl锁仍然有效
+	servers["default"].FastForward(200 * time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+	servers["default"].FastForward(200 * time.Millisecond)
+	if !servers["default"].Exists("lock:test") {
+		t.Fatal("lock should be renewed")
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err = Lock(waitCtx, "default", "lock:test", time.Second); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Lock err = %v, want DeadlineExceeded", err)
+	}
+
+	if err = lock.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = lock.Unlock(ctx); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatalf("Unlock again err = %v, want ErrLockNotHeld", err)
+	}
+
+	lock, err = TryLock(ctx, "default", "lock:test", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Unlock(ctx)
+}
+
+func TestRedlock(t *testing.T) {
+	servers := newTestRedis(t, "r1", "r2", "r3")
+	ctx := context.Background()
+
+	// 一个实例上已被占用，仍然可以获得多数
+	servers["r3"].Set("lock:redlock", "other")
+
+	lock, err := Redlock(ctx, []string{"r1", "r2", "r3"}, "lock:redlock", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err = Redlock(waitCtx, []string{"r1", "r2", "r3"}, "lock:redlock", time.Second); err == nil {
+		t.Fatal("expect redlock to fail while held")
+	}
+
+	if err = lock.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := servers["r3"].Get("lock:redlock"); v != "other" {
+		t.Fatal("unlock should not release lock held by others")
+	}
+}
+
+func isLockTTLError(err error) bool {
+	return err != nil && !errors.Is(err, ErrLockNotAcquired) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func TestLockTTL(t *testing.T) {
+	newTestRedis(t, "default")
+	// 超时只用于防止校验失效时Lock一直重试
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	for _, ttl := range []time.Duration{0, time.Nanosecond, time.Microsecond, time.Millisecond, 2 * time.Millisecond} {
+		if _, err := Lock(ctx, "default", "lock:ttl", ttl); !isLockTTLError(err) {
+			t.Errorf("Lock ttl %s err %v", ttl, err)
+		}
+		if _, err := TryLock(ctx, "default", "lock:ttl", ttl); !isLockTTLError(err) {
+			t.Errorf("TryLock ttl %s err %v", ttl, err)
+		}
+		if _, err := Redlock(ctx, []string{"default"}, "lock:ttl", ttl); !isLockTTLError(err) {
+			t.Errorf("Redlock ttl %s err %v", ttl, err)
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package shiba
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/windzhu0514/shiba/log"
+)
+
+// redis stream消费者
+// 消费者在配置文件中声明，处理函数在代码中按名称注册，启动时创建消费组
+// 处理函数返回nil时ack，返回错误时消息留在pending列表，空闲claimIdle后被重新认领（需要redis 6.2+）
+// 投递次数超过maxDeliveries的消息转入死信stream并ack
+//
+//	redisStream:
+//	  order:
+//	    redis: default
+//	    stream: order:events
+//	    group: order-service
+//	    concurrency: 4
+//
+//	shiba.HandleStream("order", func(ctx context.Context, msg redis.XMessage) error {
+//		return nil
+//	})
+
+func init() {
+	registerModule(-97, streams)
+}
+
+// StreamHandler 处理一条消息，返回nil时ack
+// 停止时超过drainTimeout后ctx被取消，处理函数应尽快返回，否则Stop不再等待它
+type StreamHandler func(ctx context.Context, msg redis.XMessage) error
+
+var streams = &streamModule{handlers: make(map[string]StreamHandler)}
+
+// HandleStream 注册redisStream配置name的处理函数，需要在服务启动前调用
+func HandleStream(name string, handler StreamHandler) {
+	streams.handle(name, handler)
+}
+
+type streamConsumerConfig struct {
+	Disable          bool          `yaml:"disable"`
+	Redis            string        `yaml:"redis"` // redis配置名，默认default
+	Stream           string        `yaml:"stream"`
+	Group            string        `yaml:"group"`
+	Consumer         string        `yaml:"consumer"`         // 消费者名称，默认hostname-pid
+	Concurrency      int           `yaml:"concurrency"`      // 并发处理数，默认1
+	BatchSize        int64         `yaml:"batchSize"`        // 每次读取的消息数，默认10
+	Block            time.Duration `yaml:"block"`            // 没有消息时阻塞等待的时间，默认2s
+	ClaimIdle        time.Duration `yaml:"claimIdle"`        // pending消息空闲超过该时间后被重新认领，应大于处理函数的最长耗时，默认5m
+	ClaimInterval    time.Duration `yaml:"claimInterval"`    // 认领检查间隔，默认等于claimIdle
+	MaxDeliveries    int64         `yaml:"maxDeliveries"`    // 最大投递次数，默认5
+	DeadLetterStream string        `yaml:"deadLetterStream"` // 死信stream，默认stream:dead
+	DrainTimeout     time.Duration `yaml:"drainTimeout"`     // 停止时等待处理中的消息完成的时间，超时后取消处理函数的ctx，再等待1s后不再等待，默认30s
+}
+
+func (cfg streamConsumerConfig) withDefault() streamConsumerConfig {
+	if cfg.Redis == "" {
+		cfg.Redis = "default"
+	}
+	if cfg.Consumer == "" {
+		cfg.Consumer = instanceID()
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 10
+	}
+	if cfg.Block <= 0 {
+		cfg.Block = 2 * time.Second
+	}
+	if cfg.ClaimIdle <= 0 {
+		cfg.ClaimIdle = 5 * time.Minute
+	}
+	if cfg.ClaimInterval <= 0 {
+		cfg.ClaimInterval = cfg.ClaimIdle
+	}
+	if cfg.MaxDeliveries <= 0 {
+		cfg.MaxDeliveries = 5
+	}
+	if cfg.DeadLetterStream == "" {
+		cfg.DeadLetterStream = cfg.Stream + ":dead"
+	}
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = 30 * time.Second
+	}
+
+	return cfg
+}
+
+type streamModule struct {
+	Config map[string]streamConsumerConfig `yaml:"redisStream"`
+
+	handlersMu sync.Mutex
+	handlers   map[string]StreamHandler
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func (p *streamModule) Name() string {
+	return "redisStream"
+}
+
+func (p *streamModule) Init() error {
+	return nil
+}
+
+func (p *streamModule) handle(name string, handler StreamHandler) {
+	p.handlersMu.Lock()
+	defer p.handlersMu.Unlock()
+
+	if _, ok := p.handlers[name]; ok {
+		panic("stream handler " + name + " is alreadly registered")
+	}
+
+	p.handlers[name] = handler
+}
+
+func (p *streamModule) Start() error {
+	p.handlersMu.Lock()
+	defer p.handlersMu.Unlock()
+
+	logger := defaultLogger.Clone("redisStream")
+	for name := range p.handlers {
+		if _, ok := p.Config[name]; !ok {
+			logger.Warnf("stream handler %s has no config, it will not start", name)
+		}
+	}
+
+	var consumers []*streamConsumer
+	for name, cfg := range p.Config {
+		if cfg.Disable {
+			continue
+		}
+
+		handler, ok := p.handlers[name]
+		if !ok {
+			return errors.New("cant find stream handler:" + name)
+		}
+
+		if cfg.Stream == "" || cfg.Group == "" {
+			return errors.New(name + ":stream and group must be set")
+		}
+
+		cfg = cfg.withDefault()
+		client, err := redisx.Get(cfg.Redis)
+		if err != nil {
+			return fmt.Errorf(name+":%w", err)
+		}
+
+		// 从头消费，消费组已存在时忽略
+		err = client.XGroupCreateMkStream(context.Background(), cfg.Stream, cfg.Group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf(name+":create group:%w", err)
+		}
+
+		consumers = append(consumers, &streamConsumer{
+			name:    name,
+			cfg:     cfg,
+			client:  client,
+			handler: handler,
+			msgs:    make(chan redis.XMessage),
+			log:     logger.With("stream", name),
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	for _, c := range consumers {
+		p.wg.Add(1)
+		go func(c *streamConsumer) {
+			defer p.wg.Done()
+			c.run(ctx)
+		}(c)
+	}
+
+	return nil
+}
+
+// Stop 停止读取新消息，等待已读取的消息处理完成，最多等待drainTimeout+streamStopGrace
+func (p *streamModule) Stop() error {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.wg.Wait()
+
+	return nil
+}
+
+type streamConsumer struct {
+	name    string
+	cfg     streamConsumerConfig
+	client  RedisCmdable
+	handler StreamHandler
+	msgs    chan redis.XMessage
+	log     log.Logger
+}
+
+// streamStopGrace 取消处理函数的ctx后继续等待的时间，处理函数不响应ctx时不再等待
+const streamStopGrace = time.Second
+
+func (c *streamConsumer) run(ctx context.Context) {
+	handleCtx, cancelHandle := context.WithCancel(context.Background())
+	defer cancelHandle()
+
+	var workers sync.WaitGroup
+	for i := 0; i < c.cfg.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for msg := range c.msgs {
+				c.process(handleCtx, msg)
+			}
+		}()
+	}
+
+	// ctx取消后开始计时，处理函数阻塞时超时后取消处理函数的ctx，未ack的消息之后被重新认领
+	// 再过streamStopGrace处理函数仍未返回时放弃等待，保证Stop在drainTimeout+streamStopGrace内返回
+	drained := make(chan struct{})
+	abandon := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-drained:
+			return
+		}
+
+		timer := time.NewTimer(c.cfg.DrainTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			c.log.Warnf("drain timeout after %s, cancel handlers", c.cfg.DrainTimeout)
+			cancelHandle()
+		case <-drained:
+			return
+		}
+
+		timer.Reset(streamStopGrace)
+		select {
+		case <-timer.C:
+			close(abandon)
+		case <-drained:
+		}
+	}()
+
+	var producers sync.WaitGroup
+	producers.Add(2)
+	go func() {
+		defer producers.Done()
+		c.readLoop(ctx)
+	}()
+	go func() {
+		defer producers.Done()
+		c.claimLoop(ctx)
+	}()
+	producers.Wait()
+
+	// 已投递给worker的消息继续处理
+	close(c.msgs)
+	workersDone := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-abandon:
+		c.log.Warnf("handlers ignore ctx after drain timeout, stop without waiting")
+	}
+	close(drained)
+}
+
+// deliver 投递消息给worker，ctx取消时返回false，未投递的消息保持pending之后被重新认领
+func (c *streamConsumer) deliver(ctx context.Context, msg redis.XMessage) bool {
+	select {
+	case c.msgs <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *streamConsumer) readLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		streams, err := c.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.cfg.Group,
+			Consumer: c.cfg.Consumer,
+			Streams:  []string{c.cfg.Stream, ">"},
+			Count:    c.cfg.BatchSize,
+			Block:    c.cfg.Block,
+		}).Result()
+		if err != nil {
+			if errors.Is(err, redis.Nil) || ctx.Err() != nil {
+				continue
+			}
+
+			c.log.Errorf("XREADGROUP:%s", err.Error())
+			sleepContext(ctx, time.Second)
+			continue
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				if !c.deliver(ctx, msg) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *streamConsumer) claimLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.ClaimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.claim(ctx); err != nil && ctx.Err() == nil {
+			c.log.Errorf("XAUTOCLAIM:%s", err.Error())
+		}
+	}
+}
+
+// claim 认领空闲的pending消息，投递次数超过maxDeliveries的转入死信stream
+func (c *streamConsumer) claim(ctx context.Context) error {
+	start := "0-0"
+	for ctx.Err() == nil {
+		next, msgs, err := c.autoClaim(ctx, start)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range msgs {
+			// redis 6.2中已删除的消息返回空值，直接ack
+			if msg.Values == nil {
+				c.client.XAck(ctx, c.cfg.Stream, c.cfg.Group, msg.ID)
+				continue
+			}
+
+			deliveries, err := c.deliveries(ctx, msg.ID)
+			if err != nil {
+				return err
+			}
+
+			if deliveries > c.cfg.MaxDeliveries {
+				if err := c.deadLetter(ctx, msg, deliveries); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !c.deliver(ctx, msg) {
+				return nil
+			}
+		}
+
+		if next == "0-0" {
+			return nil
+		}
+		start = next
+	}
+
+	return nil
+}
+
+// autoClaim 使用Do执行XAUTOCLAIM，兼容redis 6.2（2个返回值）和7.0（3个返回值）
+func (c *streamConsumer) autoClaim(ctx context.Context, start string) (string, []redis.XMessage, error) {
+	doer, ok := c.client.(interface {
+		Do(ctx context.Context, args ...interface{}) *redis.Cmd
+	})
+	if !ok {
+		return "", nil, errors.New("redis client does not support Do")
+	}
+
+	result, err := doer.Do(ctx, "XAUTOCLAIM", c.cfg.Stream, c.cfg.Group, c.cfg.Consumer,
+		c.cfg.ClaimIdle.Milliseconds(), start, "COUNT", c.cfg.BatchSize).Result()
+	if err != nil {
+		return "", nil, err
+	}
+
+	reply, ok := result.([]interface{})
+	if !ok || len(reply) < 2 {
+		return "", nil, errors.New("unexpected XAUTOCLAIM reply")
+	}
+
+	next, _ := reply[0].(string)
+	entries, _ := reply[1].([]interface{})
+
+	msgs := make([]redis.XMessage, 0, len(entries))
+	for _, entry := range entries {
+		fields, ok := entry.([]interface{})
+		if !ok || len(fields) != 2 {
+			continue
+		}
+
+		id, _ := fields[0].(string)
+		msg := redis.XMessage{ID: id}
+		if values, ok := fields[1].([]interface{}); ok {
+			msg.Values = make(map[string]interface{}, len(values)/2)
+			for i := 0; i+1 < len(values); i += 2 {
+				key, _ := values[i].(string)
+				msg.Values[key] = values[i+1]
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return next, msgs, nil
+}
+
+func (c *streamConsumer) deliveries(ctx context.Context, id string) (int64, error) {
+	pending, err := c.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: c.cfg.Stream,
+		Group:  c.cfg.Group,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	return pending[0].RetryCount, nil
+}
+
+// deadLetter 写入死信stream后ack，死信消息附带原stream、消费组、消息id和投递次数
+func (c *streamConsumer) deadLetter(ctx context.Context, msg redis.XMessage, deliveries int64) error {
+	values := make(map[string]interface{}, len(msg.Values)+4)
+	for k, v := range msg.Values {
+		values[k] = v
+	}
+	values["_stream"] = c.cfg.Stream
+	values["_group"] = c.cfg.Group
+	values["_id"] = msg.ID
+	values["_deliveries"] = deliveries
+
+	if err := c.client.XAdd(ctx, &redis.XAddArgs{Stream: c.cfg.DeadLetterStream, Values: values}).Err(); err != nil {
+		return fmt.Errorf("dead letter %s:%w", msg.ID, err)
+	}
+
+	c.log.Warnf("message %s delivered %d times, moved to %s", msg.ID, deliveries, c.cfg.DeadLetterStream)
+	return c.client.XAck(ctx, c.cfg.Stream, c.cfg.Group, msg.ID).Err()
+}
+
+func (c *streamConsumer) process(ctx context.Context, msg redis.XMessage) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.Errorf("handle message %s panic:%v", msg.ID, r)
+		}
+	}()
+
+	if err := c.handler(ctx, msg); err != nil {
+		c.log.Warnf("handle message %s:%s", msg.ID, err.Error())
+		return
+	}
+
+	if err := c.client.XAck(context.Background(), c.cfg.Stream, c.cfg.Group, msg.ID).Err(); err != nil {
+		c.log.Errorf("XACK %s:%s", msg.ID, err.Error())
+	}
+}
+
+// sleepContext 等待d或ctx结束
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
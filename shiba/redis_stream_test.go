@@ -0,0 +1,186 @@
+package shiba
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestStreamConsumer(t *testing.T) {
+	newTestRedis(t, "default")
+
+	var handled int32
+	p := &streamModule{
+		Config: map[string]streamConsumerConfig{
+			"order": {
+				Stream:        "orders",
+				Group:         "g",
+				Concurrency:   2,
+				Block:         20 * time.Millisecond,
+				ClaimIdle:     50 * time.Millisecond,
+				MaxDeliveries: 2,
+			},
+		},
+		handlers: map[string]StreamHandler{
+			"order": func(ctx context.Context, msg redis.XMessage) error {
+				if msg.Values["type"] == "bad" {
+					return errors.New("bad message")
+				}
+				atomic.AddInt32(&handled, 1)
+				return nil
+			},
+		},
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := redisx.Get("default")
+	ctx := context.Background()
+	for _, typ := range []string{"good", "bad", "good"} {
+		client.XAdd(ctx, &redis.XAddArgs{Stream: "orders", Values: map[string]interface{}{"type": typ}})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.XLen(ctx, "orders:dead").Val() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("bad message not dead-lettered")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&handled); n != 2 {
+		t.Fatalf("handled %d messages", n)
+	}
+
+	pending := client.XPending(ctx, "orders", "g").Val()
+	if pending.Count != 0 {
+		t.Fatalf("pending %d messages", pending.Count)
+	}
+
+	dead := client.XRange(ctx, "orders:dead", "-", "+").Val()
+	if dead[0].Values["type"] != "bad" || dead[0].Values["_deliveries"] != "3" {
+		t.Fatalf("unexpected dead letter %v", dead[0].Values)
+	}
+}
+
+func TestStreamConsumerDrainTimeout(t *testing.T) {
+	newTestRedis(t, "default")
+
+	client, _ := redisx.Get("default")
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		client.XAdd(ctx, &redis.XAddArgs{Stream: "orders", Values: map[string]interface{}{"i": i}})
+	}
+
+	started := make(chan struct{}, 1)
+	p := &streamModule{
+		Config: map[string]streamConsumerConfig{
+			"order": {
+				Stream:       "orders",
+				Group:        "g",
+				Concurrency:  1,
+				Block:        20 * time.Millisecond,
+				DrainTimeout: 100 * time.Millisecond,
+			},
+		},
+		handlers: map[string]StreamHandler{
+			// 处理函数一直阻塞到ctx取消
+			"order": func(ctx context.Context, msg redis.XMessage) error {
+				started <- struct{}{}
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		},
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not started")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop blocked by hanging handler")
+	}
+
+	// 未ack的消息保留在pending中
+	if pending := client.XPending(ctx, "orders", "g").Val(); pending.Count != 3 {
+		t.Fatalf("pending %d messages", pending.Count)
+	}
+}
+
+func TestStreamConsumerDrainTimeoutIgnoreCtx(t *testing.T) {
+	newTestRedis(t, "default")
+
+	client, _ := redisx.Get("default")
+	ctx := context.Background()
+	client.XAdd(ctx, &redis.XAddArgs{Stream: "orders", Values: map[string]interface{}{"i": 0}})
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	p := &streamModule{
+		Config: map[string]streamConsumerConfig{
+			"order": {
+				Stream:       "orders",
+				Group:        "g",
+				Concurrency:  1,
+				Block:        20 * time.Millisecond,
+				DrainTimeout: 100 * time.Millisecond,
+			},
+		},
+		handlers: map[string]StreamHandler{
+			// 处理函数不响应ctx
+			"order": func(ctx context.Context, msg redis.XMessage) error {
+				started <- struct{}{}
+				<-release
+				return nil
+			},
+		},
+	}
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not started")
+	}
+
+	begin := time.Now()
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop blocked by handler ignoring ctx")
+	}
+	if d := time.Since(begin); d > 100*time.Millisecond+streamStopGrace+time.Second {
+		t.Fatalf("stop took %s", d)
+	}
+}
@@ -0,0 +1,326 @@
+package shiba
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestRedis 为每个name启动一个miniredis，并替换redis模块的配置
+func newTestRedis(t *testing.T, names ...string) map[string]*miniredis.Miniredis {
+	t.Helper()
+
+	servers := make(map[string]*miniredis.Miniredis)
+	config := make(map[string]redisConfig)
+	for _, name := range names {
+		s := miniredis.RunT(t)
+		servers[name] = s
+		config[name] = redisConfig{Address: []string{s.Addr()}}
+	}
+
+	old := redisx
+	redisx = &redisPool{Config: config}
+	redisx.Init()
+	t.Cleanup(func() {
+		redisx.Stop()
+		redisx = old
+	})
+
+	return servers
+}
+
+func TestRedisHook(t *testing.T) {
+	newTestRedis(t, "hook")
+
+	client, err := redisx.Get("hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 指标是全局的，-count多次运行时按差值比较
+	getErrors := testutil.ToFloat64(redisCmdErrors.WithLabelValues("hook", "get"))
+	incrErrors := testutil.ToFloat64(redisCmdErrors.WithLabelValues("hook", "incr"))
+
+	tracer := mocktracer.New()
+	parent := tracer.StartSpan("parent")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+
+	client.Set(ctx, "k", "v", 0)
+	client.Get(ctx, "missing")
+	client.Incr(ctx, "k") // 值不是整数，返回错误
+	parent.Finish()
+
+	if n := testutil.ToFloat64(redisCmdErrors.WithLabelValues("hook", "get")) - getErrors; n != 0 {
+		t.Fatalf("redis.Nil counted as error: %v", n)
+	}
+	if n := testutil.ToFloat64(redisCmdErrors.WithLabelValues("hook", "incr")) - incrErrors; n != 1 {
+		t.Fatalf("incr errors %v", n)
+	}
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 4 {
+		t.Fatalf("finished spans %d", len(spans))
+	}
+	if spans[0].OperationName != "redis set" || spans[0].ParentID != parent.(*mocktracer.MockSpan).SpanContext.SpanID {
+		t.Fatalf("unexpected span %s", spans[0].OperationName)
+	}
+	if spans[2].Tag("error") != true {
+		t.Fatal("incr span not marked as error")
+	}
+}
+
+func TestRedisGetConcurrent(t *testing.T) {
+	newTestRedis(t, "a", "b")
+
+	// 已建立的连接池读取和另一个连接池的建立并发进行
+	first, err := redisx.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if client, err := redisx.Get("a"); err != nil || client != first {
+				t.Errorf("Get a = %v, %v", client, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := redisx.Get("b"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRedisClientMode(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  redisConfig
+		want string // 客户端类型，为空时期望返回错误
+	}{
+		{"standalone", redisConfig{}, "*redis.Client"},
+		{"isCluster", redisConfig{IsCluster: true}, "*redis.ClusterClient"},
+		{"cluster", redisConfig{Mode: RedisModeCluster}, "*redis.ClusterClient"},
+		{"sentinel", redisConfig{Mode: RedisModeSentinel, MasterName: "mymaster"}, "*redis.Client"},
+		{"sentinelReplicaOnly", redisConfig{Mode: RedisModeSentinel, MasterName: "mymaster", ReplicaOnly: true}, "*redis.Client"},
+		{"sentinelRouteByLatency", redisConfig{Mode: RedisModeSentinel, MasterName: "mymaster", RouteByLatency: true}, "*redis.ClusterClient"},
+		{"sentinelRouteRandomly", redisConfig{Mode: RedisModeSentinel, MasterName: "mymaster", RouteRandomly: true}, "*redis.ClusterClient"},
+		{"sentinelRouteDBIndex", redisConfig{Mode: RedisModeSentinel, MasterName: "mymaster", RouteByLatency: true, DBIndex: 1}, ""},
+		{"sentinelNoMaster", redisConfig{Mode: RedisModeSentinel}, ""},
+		{"unsupported", redisConfig{Mode: "proxy"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Address = []string{"127.0.0.1:6379"}
+			opt, err := tt.cfg.universalOptions()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client, err := tt.cfg.client(opt)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatal("expect error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.(io.Closer).Close()
+
+			if got := fmt.Sprintf("%T", client); got != tt.want {
+				t.Fatalf("client %s want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedisFailoverOptions(t *testing.T) {
+	cfg := redisConfig{
+		Mode:             RedisModeSentinel,
+		Address:          []string{"127.0.0.1:26379", "127.0.0.1:26380"},
+		MasterName:       "mymaster",
+		SentinelPassword: "sentinel",
+		Password:         "secret",
+		DBIndex:          2,
+		RouteByLatency:   true,
+		RouteRandomly:    true,
+		ReplicaOnly:      true,
+	}
+	opt, err := cfg.universalOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failoverOpt := cfg.failoverOptions(opt)
+	if failoverOpt.MasterName != "mymaster" || failoverOpt.SentinelPassword != "sentinel" ||
+		failoverOpt.Password != "secret" || failoverOpt.DB != 2 || len(failoverOpt.SentinelAddrs) != 2 {
+		t.Fatalf("failover options %+v", failoverOpt)
+	}
+	if !failoverOpt.RouteByLatency || !failoverOpt.RouteRandomly || !failoverOpt.SlaveOnly {
+		t.Fatalf("failover routing %+v", failoverOpt)
+	}
+}
+
+func TestRedisPoolNew(t *testing.T) {
+	s := miniredis.RunT(t)
+	p := &redisPool{}
+
+	if _, err := p.new("empty", redisConfig{}); err == nil || !strings.HasPrefix(err.Error(), "empty:") {
+		t.Fatalf("empty address %v", err)
+	}
+	if _, err := p.new("sentinel", redisConfig{Mode: RedisModeSentinel, Address: []string{s.Addr()}}); err == nil ||
+		err.Error() != "sentinel:masterName is empty" {
+		t.Fatalf("sentinel %v", err)
+	}
+
+	client, err := p.new("standalone", redisConfig{Address: []string{s.Addr()}, DBIndex: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.(io.Closer).Close()
+
+	if err := client.Set(context.Background(), "k", "v", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	s.Select(1)
+	if v, _ := s.Get("k"); v != "v" {
+		t.Fatalf("db 1 value %q", v)
+	}
+}
+
+// writeTestCert 生成自签名证书，返回证书和私钥文件
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "redis"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestRedisTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir)
+	invalidFile := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalidFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if tlsCfg, err := (redisTLSConfig{CAFile: certFile}).tlsConfig(); tlsCfg != nil || err != nil {
+		t.Fatalf("disabled %v %v", tlsCfg, err)
+	}
+
+	tlsCfg, err := redisTLSConfig{
+		Enable:             true,
+		CAFile:             certFile,
+		CertFile:           certFile,
+		KeyFile:            keyFile,
+		ServerName:         "redis.local",
+		InsecureSkipVerify: true,
+	}.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsCfg.RootCAs == nil || len(tlsCfg.Certificates) != 1 || tlsCfg.ServerName != "redis.local" ||
+		!tlsCfg.InsecureSkipVerify || tlsCfg.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("tls config %+v", tlsCfg)
+	}
+
+	for name, cfg := range map[string]redisTLSConfig{
+		"caMissing":  {Enable: true, CAFile: filepath.Join(dir, "missing.pem")},
+		"caInvalid":  {Enable: true, CAFile: invalidFile},
+		"keyMissing": {Enable: true, CertFile: certFile},
+		"keyInvalid": {Enable: true, CertFile: certFile, KeyFile: invalidFile},
+	} {
+		if _, err := cfg.tlsConfig(); err == nil {
+			t.Errorf("%s expect error", name)
+		}
+	}
+}
+
+func TestRedisUniversalOptions(t *testing.T) {
+	cfg := redisConfig{
+		Address:      []string{"127.0.0.1:6379"},
+		DBIndex:      3,
+		Username:     "user",
+		Password:     "secret",
+		PoolSize:     20,
+		MinIdleConns: 5,
+		DialTimeout:  time.Second,
+		ReadTimeout:  -1,
+		WriteTimeout: 2 * time.Second,
+		PoolTimeout:  4 * time.Second,
+		IdleTimeout:  time.Minute,
+		MaxRetries:   -1,
+		ReadOnly:     true,
+	}
+	opt, err := cfg.universalOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt.DB != 3 || opt.Username != "user" || opt.Password != "secret" || opt.PoolSize != 20 || opt.MinIdleConns != 5 ||
+		opt.DialTimeout != time.Second || opt.ReadTimeout != -1 || opt.WriteTimeout != 2*time.Second ||
+		opt.PoolTimeout != 4*time.Second || opt.IdleTimeout != time.Minute || opt.MaxRetries != -1 ||
+		!opt.ReadOnly || opt.TLSConfig != nil {
+		t.Fatalf("options %+v", opt)
+	}
+
+	cfg.TLS = redisTLSConfig{Enable: true, CAFile: filepath.Join(t.TempDir(), "missing.pem")}
+	if _, err := cfg.universalOptions(); err == nil || !strings.HasPrefix(err.Error(), "tls:") {
+		t.Fatalf("tls error %v", err)
+	}
+}
@@ -0,0 +1,476 @@
+package shiba
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 根据结构体db tag生成INSERT/UPDATE/SELECT语句
+// tag格式：db:"列名[,pk][,omitempty]"
+//   pk        主键，UpdateByPK的条件列、Upsert的冲突列
+//   omitempty 零值时不写入该列（如自增id、有默认值的列）
+//   -         忽略该字段
+// 未设置db tag的结构体字段（包括匿名嵌入结构体）会展开其中的字段
+// db参数可以传入*sqlx.DB或*sqlx.Tx
+
+var ErrNoPrimaryKey = errors.New("struct has no pk field")
+
+// 单条语句占位符数量上限
+var maxPlaceholders = map[string]int{
+	DriverMySQL:    65535,
+	DriverPostgres: 65535,
+	DriverSQLite:   32766,
+}
+
+type dbField struct {
+	name      string
+	pk        bool
+	omitEmpty bool
+	index     []int
+}
+
+var dbFieldsCache sync.Map // map[reflect.Type][]dbField
+
+// parseDBTag 解析db tag，返回列名和选项
+func parseDBTag(tag string) (name string, pk, omitEmpty bool) {
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		switch strings.TrimSpace(opt) {
+		case "pk":
+			pk = true
+		case "omitempty":
+			omitEmpty = true
+		}
+	}
+
+	return parts[0], pk, omitEmpty
+}
+
+// structDBFields 获取结构体中有db tag的字段，展开嵌入结构体
+func structDBFields(rt reflect.Type) []dbField {
+	if fields, ok := dbFieldsCache.Load(rt); ok {
+		return fields.([]dbField)
+	}
+
+	fields := appendDBFields(nil, rt, nil)
+	dbFieldsCache.Store(rt, fields)
+	return fields
+}
+
+func appendDBFields(fields []dbField, rt reflect.Type, parent []int) []dbField {
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		index := append(append([]int(nil), parent...), i)
+
+		tag, hasTag := sf.Tag.Lookup("db")
+		if tag == "-" {
+			continue
+		}
+
+		// 未导出字段，嵌入的结构体可能有导出字段
+		if sf.PkgPath != "" && !sf.Anonymous {
+			continue
+		}
+
+		// 和sqlx一致，只展开嵌入结构体，具名结构体字段在sqlx中映射为addr.street，不能作为列
+		if !hasTag || tag == "" {
+			if !sf.Anonymous {
+				continue
+			}
+
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+
+			if ft.Kind() == reflect.Struct {
+				fields = appendDBFields(fields, ft, index)
+			}
+			continue
+		}
+
+		name, pk, omitEmpty := parseDBTag(tag)
+		if name == "" {
+			continue
+		}
+
+		fields = append(fields, dbField{name: name, pk: pk, omitEmpty: omitEmpty, index: index})
+	}
+
+	return fields
+}
+
+// fieldByIndex 嵌入结构体指针为nil时返回无效值
+func fieldByIndex(rv reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				return reflect.Value{}
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+
+	return rv
+}
+
+func fieldValue(rv reflect.Value, f dbField) (interface{}, bool) {
+	fv := fieldByIndex(rv, f.index)
+	if !fv.IsValid() {
+		return nil, false
+	}
+
+	return fv.Interface(), !fv.IsZero()
+}
+
+func structValue(row interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(row)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return reflect.Value{}, errors.New("row is nil")
+		}
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("row must be a struct, found: %s", rv.Kind())
+	}
+
+	return rv, nil
+}
+
+// quoteIdent 按驱动转义表名、列名，支持schema.table
+func quoteIdent(driverName, ident string) string {
+	quote := `"`
+	if driverName == DriverMySQL {
+		quote = "`"
+	}
+
+	parts := strings.Split(ident, ".")
+	for i, part := range parts {
+		parts[i] = quote + strings.ReplaceAll(part, quote, quote+quote) + quote
+	}
+
+	return strings.Join(parts, ".")
+}
+
+func quoteIdents(driverName string, idents []string) []string {
+	quoted := make([]string, len(idents))
+	for i, ident := range idents {
+		quoted[i] = quoteIdent(driverName, ident)
+	}
+
+	return quoted
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// insertColumns 返回写入的列和值，omitempty且为零值的列不写入
+func insertColumns(rv reflect.Value) (columns []string, values []interface{}) {
+	for _, f := range structDBFields(rv.Type()) {
+		v, nonZero := fieldValue(rv, f)
+		if f.omitEmpty && !nonZero {
+			continue
+		}
+
+		columns = append(columns, f.name)
+		values = append(values, v)
+	}
+
+	return columns, values
+}
+
+func insertSQL(driverName, table string, columns []string, rows int) string {
+	values := make([]string, rows)
+	for i := range values {
+		values[i] = "(" + placeholders(len(columns)) + ")"
+	}
+
+	return "INSERT INTO " + quoteIdent(driverName, table) +
+		" (" + strings.Join(quoteIdents(driverName, columns), ",") + ") VALUES " +
+		strings.Join(values, ",")
+}
+
+// Insert 插入一行
+func Insert(ctx context.Context, db sqlx.ExtContext, table string, row interface{}) (sql.Result, error) {
+	rv, err := structValue(row)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, values := insertColumns(rv)
+	if len(columns) == 0 {
+		return nil, errors.New("no column to insert")
+	}
+
+	query := insertSQL(db.DriverName(), table, columns, 1)
+	return db.ExecContext(ctx, db.Rebind(query), values...)
+}
+
+// BulkInsert 批量插入，每batchSize行一条语句，batchSize<=0时只受占位符数量限制
+// 所有行的写入列相同，omitempty列只有在所有行都为零值时才不写入
+// 多个批次不在同一事务中，需要原子性时传入*sqlx.Tx
+func BulkInsert[T any](ctx context.Context, db sqlx.ExtContext, table string, rows []T, batchSize int) (int64, error) {
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	rvs := make([]reflect.Value, len(rows))
+	for i := range rows {
+		rv, err := structValue(rows[i])
+		if err != nil {
+			return 0, err
+		}
+		rvs[i] = rv
+	}
+
+	var fields []dbField
+	for _, f := range structDBFields(rvs[0].Type()) {
+		if f.omitEmpty {
+			empty := true
+			for _, rv := range rvs {
+				if _, nonZero := fieldValue(rv, f); nonZero {
+					empty = false
+					break
+				}
+			}
+
+			if empty {
+				continue
+			}
+		}
+
+		fields = append(fields, f)
+	}
+
+	if len(fields) == 0 {
+		return 0, errors.New("no column to insert")
+	}
+
+	columns := make([]string, len(fields))
+	for i, f := range fields {
+		columns[i] = f.name
+	}
+
+	batchSize, err := bulkBatchSize(db.DriverName(), len(columns), len(rows), batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var affected int64
+	for start := 0; start < len(rvs); start += batchSize {
+		end := start + batchSize
+		if end > len(rvs) {
+			end = len(rvs)
+		}
+
+		values := make([]interface{}, 0, (end-start)*len(fields))
+		for _, rv := range rvs[start:end] {
+			for _, f := range fields {
+				v, _ := fieldValue(rv, f)
+				values = append(values, v)
+			}
+		}
+
+		query := insertSQL(db.DriverName(), table, columns, end-start)
+		result, err := db.ExecContext(ctx, db.Rebind(query), values...)
+		if err != nil {
+			return affected, fmt.Errorf("bulk insert rows [%d,%d):%w", start, end, err)
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return affected, err
+		}
+		affected += n
+	}
+
+	return affected, nil
+}
+
+// Upsert 插入一行，主键或唯一键冲突时更新非pk列
+// mysql使用ON DUPLICATE KEY UPDATE，postgres、sqlite使用ON CONFLICT(pk列) DO UPDATE
+func Upsert(ctx context.Context, db sqlx.ExtContext, table string, row interface{}) (sql.Result, error) {
+	rv, err := structValue(row)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, values := insertColumns(rv)
+	if len(columns) == 0 {
+		return nil, errors.New("no column to insert")
+	}
+
+	var pks []string
+	for _, f := range structDBFields(rv.Type()) {
+		if f.pk {
+			pks = append(pks, f.name)
+		}
+	}
+
+	driverName := db.DriverName()
+	var updates []string
+	for _, column := range columns {
+		if inStrings(column, pks) {
+			continue
+		}
+
+		quoted := quoteIdent(driverName, column)
+		if driverName == DriverMySQL {
+			updates = append(updates, quoted+"=VALUES("+quoted+")")
+		} else {
+			updates = append(updates, quoted+"=EXCLUDED."+quoted)
+		}
+	}
+
+	query := insertSQL(driverName, table, columns, 1)
+	if driverName == DriverMySQL {
+		if len(updates) == 0 {
+			// 只有主键列时冲突不做任何修改
+			quoted := quoteIdent(driverName, columns[0])
+			updates = append(updates, quoted+"="+quoted)
+		}
+		query += " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ",")
+	} else {
+		if len(pks) == 0 {
+			return nil, ErrNoPrimaryKey
+		}
+
+		query += " ON CONFLICT (" + strings.Join(quoteIdents(driverName, pks), ",") + ")"
+		if len(updates) == 0 {
+			query += " DO NOTHING"
+		} else {
+			query += " DO UPDATE SET " + strings.Join(updates, ",")
+		}
+	}
+
+	return db.ExecContext(ctx, db.Rebind(query), values...)
+}
+
+// UpdateByPK 按pk列更新其他列，omitempty且为零值的列不更新
+func UpdateByPK(ctx context.Context, db sqlx.ExtContext, table string, row interface{}) (int64, error) {
+	rv, err := structValue(row)
+	if err != nil {
+		return 0, err
+	}
+
+	driverName := db.DriverName()
+	var (
+		sets      []string
+		wheres    []string
+		setArgs   []interface{}
+		whereArgs []interface{}
+	)
+	for _, f := range structDBFields(rv.Type()) {
+		v, nonZero := fieldValue(rv, f)
+		if f.pk {
+			wheres = append(wheres, quoteIdent(driverName, f.name)+"=?")
+			whereArgs = append(whereArgs, v)
+			continue
+		}
+
+		if f.omitEmpty && !nonZero {
+			continue
+		}
+
+		sets = append(sets, quoteIdent(driverName, f.name)+"=?")
+		setArgs = append(setArgs, v)
+	}
+
+	if len(wheres) == 0 {
+		return 0, ErrNoPrimaryKey
+	}
+
+	if len(sets) == 0 {
+		return 0, errors.New("no column to update")
+	}
+
+	query := "UPDATE " + quoteIdent(driverName, table) + " SET " + strings.Join(sets, ",") +
+		" WHERE " + strings.Join(wheres, " AND ")
+	result, err := db.ExecContext(ctx, db.Rebind(query), append(setArgs, whereArgs...)...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// SelectWhere 查询T的db tag对应的列，where为空时查询全表
+// where中使用?占位符，如：SelectWhere[User](ctx, db, "user", "age > ? ORDER BY id", 18)
+// where原样执行，postgres配置disableRebind时使用$n占位符
+func SelectWhere[T any](ctx context.Context, db sqlx.ExtContext, table, where string, args ...interface{}) ([]T, error) {
+	rt := reflect.TypeOf((*T)(nil)).Elem()
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+
+	if rt.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("T must be a struct, found: %s", rt.Kind())
+	}
+
+	fields := structDBFields(rt)
+	if len(fields) == 0 {
+		return nil, errors.New("struct has no db field")
+	}
+
+	columns := make([]string, len(fields))
+	for i, f := range fields {
+		columns[i] = f.name
+	}
+
+	driverName := db.DriverName()
+	query := "SELECT " + strings.Join(quoteIdents(driverName, columns), ",") +
+		" FROM " + quoteIdent(driverName, table)
+	if where != "" {
+		query += " WHERE " + where
+	}
+
+	var rows []T
+	if err := sqlx.SelectContext(ctx, db, &rows, query, args...); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func inStrings(s string, arr []string) bool {
+	for _, a := range arr {
+		if a == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bulkBatchSize 每批插入的行数，不超过数据库的占位符数量限制
+func bulkBatchSize(driverName string, columns, rows, batchSize int) (int, error) {
+	limit, ok := maxPlaceholders[driverName]
+	if !ok {
+		if batchSize <= 0 {
+			batchSize = rows
+		}
+		return batchSize, nil
+	}
+
+	maxRows := limit / columns
+	if maxRows == 0 {
+		return 0, fmt.Errorf("%d columns exceeds the placeholder limit %d of %s", columns, limit, driverName)
+	}
+
+	if batchSize <= 0 || batchSize > maxRows {
+		batchSize = maxRows
+	}
+
+	return batchSize, nil
+}
@@ -0,0 +1,146 @@
+package shiba
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testBase struct {
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type testUser struct {
+	ID   int64  `db:"id,pk,omitempty"`
+	Name string `db:"name"`
+	Age  int    `db:"age,omitempty"`
+	testBase
+	Ignore string `db:"-"`
+}
+
+func TestDBFields(t *testing.T) {
+	fields := DBFields(reflect.ValueOf(&testUser{}))
+	want := []string{"id", "name", "age", "created_at"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("DBFields = %v, want %v", fields, want)
+	}
+}
+
+type testInner struct {
+	Secret string `db:"secret"`
+}
+
+type testProfile struct {
+	ID    int64 `db:"id"`
+	inner testInner
+	testBase
+}
+
+func TestDBFieldsUnexported(t *testing.T) {
+	fields := DBFields(reflect.ValueOf(&testProfile{}))
+	want := []string{"id", "created_at"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("DBFields = %v, want %v", fields, want)
+	}
+
+	rv, err := structValue(&testProfile{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range structDBFields(rv.Type()) {
+		fieldValue(rv, f)
+	}
+}
+
+type testAddress struct {
+	Street string `db:"street"`
+}
+
+type testCustomer struct {
+	ID   int64 `db:"id"`
+	Addr testAddress
+	testBase
+}
+
+func TestDBFieldsNamedStruct(t *testing.T) {
+	fields := DBFields(reflect.ValueOf(&testCustomer{}))
+	want := []string{"id", "created_at"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("DBFields = %v, want %v", fields, want)
+	}
+}
+
+func TestBulkBatchSize(t *testing.T) {
+	if n, err := bulkBatchSize(DriverSQLite, 3, 10, 0); err != nil || n != 32766/3 {
+		t.Fatalf("batch size %d, %v", n, err)
+	}
+	if n, err := bulkBatchSize("unknown", 3, 10, 0); err != nil || n != 10 {
+		t.Fatalf("batch size %d, %v", n, err)
+	}
+	if _, err := bulkBatchSize(DriverSQLite, 40000, 10, 0); err == nil {
+		t.Fatal("expect error for too many columns")
+	}
+}
+
+func TestRepository(t *testing.T) {
+	ctx := context.Background()
+	xdb, err := newTestDatabase(t).Master("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = xdb.Exec(`CREATE TABLE user (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		age INTEGER NOT NULL DEFAULT 18,
+		created_at DATETIME)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if _, err = Insert(ctx, xdb, "user", &testUser{Name: "a", testBase: testBase{CreatedAt: now}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := make([]testUser, 5)
+	for i := range rows {
+		rows[i] = testUser{Name: "bulk", Age: i + 1, testBase: testBase{CreatedAt: now}}
+	}
+
+	n, err := BulkInsert(ctx, xdb, "user", rows, 2)
+	if err != nil || n != 5 {
+		t.Fatalf("BulkInsert = %d, %v", n, err)
+	}
+
+	n, err = UpdateByPK(ctx, xdb, "user", &testUser{ID: 1, Name: "b", testBase: testBase{CreatedAt: now}})
+	if err != nil || n != 1 {
+		t.Fatalf("UpdateByPK = %d, %v", n, err)
+	}
+
+	if _, err = Upsert(ctx, xdb, "user", &testUser{ID: 1, Name: "c", Age: 20, testBase: testBase{CreatedAt: now}}); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := SelectWhere[testUser](ctx, xdb, "user", "id = ?", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := testUser{ID: 1, Name: "c", Age: 20, testBase: testBase{CreatedAt: now}}
+	if len(users) != 1 || !reflect.DeepEqual(users[0], want) {
+		t.Fatalf("SelectWhere = %+v, want %+v", users, want)
+	}
+
+	users, err = SelectWhere[testUser](ctx, xdb, "user", "name = ? ORDER BY id", "bulk")
+	if err != nil || len(users) != 5 || users[4].Age != 5 {
+		t.Fatalf("SelectWhere = %+v, %v", users, err)
+	}
+
+	if _, err = UpdateByPK(ctx, xdb, "user", &struct {
+		Name string `db:"name"`
+	}{}); err != ErrNoPrimaryKey {
+		t.Fatalf("UpdateByPK without pk err = %v", err)
+	}
+}
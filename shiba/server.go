@@ -1,24 +1,31 @@
 package shiba
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"net/http/pprof"
 	"os"
+	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/robfig/cron/v3"
 
+	"github.com/windzhu0514/shiba/cache"
 	"github.com/windzhu0514/shiba/hihttp"
 	"github.com/windzhu0514/shiba/log"
 )
 
 var defaultServer *Server
 
+// probePaths 只读的探活和指标接口，签名校验时跳过，其他内置接口需要签名
+var probePaths = []string{"/health", "/metrics"}
+
 func NewServer(opts ...Option) *Server {
 	defaultServer = &Server{
 		router: mux.NewRouter(),
@@ -33,27 +40,44 @@ func NewServer(opts ...Option) *Server {
 }
 
 type ServerConfig struct {
-	ServiceName           string `yaml:"serviceName"`
-	Port                  string `yaml:"port"`
-	CertFile              string `yaml:"certFile"`
-	KeyFile               string `yaml:"keyFile"`
-	DisableSignatureCheck bool   `yaml:"disableSignatureCheck"`
-	TracingAgentHostPort  string `yaml:"tracingAgentHostPort"`
+	ServiceName           string          `yaml:"serviceName"`
+	Port                  string          `yaml:"port"`
+	CertFile              string          `yaml:"certFile"`
+	KeyFile               string          `yaml:"keyFile"`
+	DisableSignatureCheck bool            `yaml:"disableSignatureCheck"`
+	TracingAgentHostPort  string          `yaml:"tracingAgentHostPort"` // 兼容旧配置，tracing.exporter为空时使用jaeger agent
+	Tracing               TracingConfig   `yaml:"tracing"`
+	Metrics               MetricsConfig   `yaml:"metrics"`
+	AccessLog             AccessLogConfig `yaml:"accessLog"`
+	Signature             SignatureConfig `yaml:"signature"` // disableSignatureCheck为true时不校验
 
 	// options
 	configFile  string
 	pprof       bool
 	openCron    bool
 	openMetric  bool
+	openAdmin   bool
 	middlewares []mux.MiddlewareFunc
 }
 
 type Server struct {
-	Config ServerConfig `yaml:"shiba"`
-	flags  *flag.FlagSet
-	router *mux.Router
-	cron   *cron.Cron
-	onStop []func()
+	Config     ServerConfig `yaml:"shiba"`
+	CronConfig cronConfig   `yaml:"cron"`
+	flags      *flag.FlagSet
+	router     *mux.Router
+	onStop     []func()
+
+	cronMu       sync.Mutex
+	cron         *cron.Cron
+	cronJobs     map[string]*cronJob    // 已添加的命名任务
+	cronHandlers map[string]CronJobFunc // RegisterCronJob注册的任务
+	cronLeaser   cronLeaser             // 分布式模式的租约
+	cronCtx      context.Context        // 任务执行的ctx，服务停止时取消
+	cronCancel   context.CancelFunc
+	cronManual   sync.WaitGroup // 手动触发正在执行的任务
+	cronStopped  bool           // stopCron后不再接受手动触发
+
+	reloadMu sync.Mutex
 }
 
 func (s *Server) Start() error {
@@ -110,20 +134,45 @@ func (s *Server) Start() error {
 	}
 
 	if s.Config.openCron {
-		cronLogger := cronLogger{logger: defaultLogger.AddCallerSkip(1)}
-		s.cron = cron.New(
-			cron.WithLogger(cronLogger),
-			cron.WithChain(cron.SkipIfStillRunning(cronLogger)),
-			cron.WithParser(cron.NewParser(
-				cron.SecondOptional|cron.Minute|cron.Hour|cron.Dom|cron.Month|cron.Dow|cron.Descriptor,
-			)))
-		s.cron.Start()
+		if err := s.startCron(); err != nil {
+			defaultLogger.Error(err.Error())
+			return err
+		}
 	}
 
 	if s.Config.openMetric {
+		if s.Config.Metrics.Namespace == "" {
+			s.Config.Metrics.Namespace = s.Config.ServiceName
+		}
+		mw := MiddlewareMetrics(s.Config.Metrics)
+		s.router.Use(mux.MiddlewareFunc(mw))
+		useUnmatched(s.router, mw)
 		s.router.Handle("/metrics", promhttp.Handler())
 	}
 
+	if s.Config.AccessLog.Enable {
+		mw, closer := MiddlewareAccessLog(s.Config.AccessLog)
+		s.registerOnStop(func() {
+			if err := closer.Close(); err != nil {
+				defaultLogger.Errorf("module [shiba] access log Close:%s\n", err.Error())
+			}
+		})
+		s.router.Use(mux.MiddlewareFunc(mw))
+		useUnmatched(s.router, mw)
+	}
+
+	if s.Config.Signature.Enable && !s.Config.DisableSignatureCheck {
+		cfg := s.Config.Signature
+		cfg.Exclude = append(append([]string{}, probePaths...), cfg.Exclude...)
+		mw, err := MiddlewareSignature(cfg)
+		if err != nil {
+			errMsg := fmt.Sprintf("server signature:%s", err.Error())
+			defaultLogger.Error(errMsg)
+			return errors.New(errMsg)
+		}
+		s.router.Use(mux.MiddlewareFunc(mw))
+	}
+
 	if s.Config.pprof {
 		s.router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
 		s.router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -136,6 +185,25 @@ func (s *Server) Start() error {
 	//  curl -X PUT localhost:8080/log_level -H "Content-Type: application/json" -d '{"level":"debug"}'
 	s.router.HandleFunc("/log_level", defaultLogger.ServeHTTP)
 
+	//  curl localhost:8080/health
+	s.router.HandleFunc("/health", s.serveHealth)
+
+	if s.Config.openAdmin {
+		//  curl -X PUT localhost:8080/config/reload
+		s.router.HandleFunc("/config/reload", s.serveReload)
+
+		//  curl localhost:8080/database/pool
+		s.router.HandleFunc("/database/pool", db.ServeHTTP)
+
+		if s.Config.openCron {
+			//  curl localhost:8080/cron
+			s.router.HandleFunc("/cron", s.serveCron)
+
+			//  curl -X PUT localhost:8080/cron/trigger?name=directLogin
+			s.router.HandleFunc("/cron/trigger", s.serveCronTrigger)
+		}
+	}
+
 	if s.Config.Port == "" {
 		s.Config.Port = "9999"
 	}
@@ -143,8 +211,13 @@ func (s *Server) Start() error {
 	svr := hihttp.NewServer(":"+s.Config.Port, s.router)
 	s.router.Use(s.Config.middlewares...)
 
-	if len(s.Config.TracingAgentHostPort) > 0 {
-		closer, err := newJaegerTracer(s.Config.ServiceName, s.Config.TracingAgentHostPort)
+	if s.Config.Tracing.Exporter == "" && len(s.Config.TracingAgentHostPort) > 0 {
+		s.Config.Tracing.Exporter = TracingExporterJaeger
+		s.Config.Tracing.Endpoint = s.Config.TracingAgentHostPort
+	}
+
+	if s.Config.Tracing.Exporter != "" {
+		closer, err := newTracer(s.Config.ServiceName, s.Config.Tracing)
 		if err != nil {
 			errMsg := fmt.Sprintf("server new Tracer:%s", err.Error())
 			defaultLogger.Error(errMsg)
@@ -185,6 +258,9 @@ func (s *Server) Start() error {
 }
 
 func (s *Server) stop() {
+	// 任务可能使用其他模块，先停止cron
+	s.stopCron()
+
 	for i := len(modules) - 1; i >= 0; i-- {
 		mod := modules[i]
 		if err := mod.Module.Stop(); err != nil {
@@ -200,6 +276,83 @@ func (s *Server) stop() {
 	}
 }
 
+// reload 重新读取配置文件，调用实现了Reloader接口的模块
+func (s *Server) reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if err := loadConfig(s.Config.configFile); err != nil {
+		return fmt.Errorf("load config file:%w", err)
+	}
+
+	for _, mod := range modules {
+		reloader, ok := mod.Module.(Reloader)
+		if !ok {
+			continue
+		}
+
+		if err := reloader.Reload(&rawFileCfg); err != nil {
+			return fmt.Errorf("module [%s] reload:%s", mod.Name, err.Error())
+		}
+
+		defaultLogger.Infof("module [%s] reload success", mod.Name)
+	}
+
+	if err := s.reloadCron(); err != nil {
+		return fmt.Errorf("cron reload:%s", err.Error())
+	}
+
+	return nil
+}
+
+func (s *Server) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "Only PUT and POST are supported.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.reload(); err != nil {
+		defaultLogger.Error("reload:" + err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// serveHealth 返回实现了HealthChecker接口的模块状态，有模块不健康时返回503
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	type moduleHealth struct {
+		Healthy bool        `json:"healthy"`
+		Detail  interface{} `json:"detail,omitempty"`
+	}
+
+	status := "up"
+	healths := make(map[string]moduleHealth)
+	for _, mod := range modules {
+		checker, ok := mod.Module.(HealthChecker)
+		if !ok {
+			continue
+		}
+
+		healthy, detail := checker.Health()
+		if !healthy {
+			status = "down"
+		}
+		healths[mod.Name] = moduleHealth{Healthy: healthy, Detail: detail}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status != "up" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  status,
+		"modules": healths,
+	})
+}
+
 func (s *Server) RegisterModule(priority int, mod Module) {
 	registerModule(priority, mod)
 }
@@ -216,6 +369,11 @@ func Logger(name string) log.Logger {
 	return defaultLogger.Clone(name)
 }
 
+// LoggerCtx 同Logger，日志中自动添加ctx中的traceId、spanId和requestId
+func LoggerCtx(ctx context.Context, name string) log.Logger {
+	return loggerWithContext(defaultLogger.Clone(name), ctx)
+}
+
 func DBMaster(name string) (*sqlx.DB, error) {
 	return db.Master(name)
 }
@@ -224,10 +382,38 @@ func DBSlave(name string) (*sqlx.DB, error) {
 	return db.Slave(name)
 }
 
+// DBShard 返回key在分片组中所在的分片
+//
+//	shard, err := shiba.DBShard("order", userID)
+//	xdb, err := shard.Master()
+func DBShard(group string, key interface{}) (Shard, error) {
+	return db.shard(group, key)
+}
+
+// DBShards 返回分片组的所有分片
+func DBShards(group string) ([]Shard, error) {
+	return db.shards(group)
+}
+
+// ShardScatter 在分片组的每个分片上并发执行fn，返回第一个错误
+func ShardScatter(ctx context.Context, group string, fn func(ctx context.Context, shard Shard) error) error {
+	return db.scatter(ctx, group, fn)
+}
+
 func Redis(name string) (RedisCmdable, error) {
 	return redisx.Get(name)
 }
 
+// RedisCache 使用redis配置name作为缓存后端，key会加上prefix:前缀
+func RedisCache(name, prefix string) (*cache.Redis, error) {
+	client, err := redisx.Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return cache.NewRedis(client, prefix), nil
+}
+
 func Router() *mux.Router {
 	return defaultServer.router
 }
@@ -237,6 +423,9 @@ func FlagSet() *flag.FlagSet {
 }
 
 func Cron() *cron.Cron {
+	defaultServer.cronMu.Lock()
+	defer defaultServer.cronMu.Unlock()
+
 	if defaultServer.cron == nil {
 		panic("cron not start")
 	}
@@ -0,0 +1,337 @@
+package shiba
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/windzhu0514/shiba/utils"
+)
+
+// 签名校验
+// shiba.signature.enable为true且未设置disableSignatureCheck时自动添加，按authId从配置中读取密钥
+//
+// /health、/metrics不校验，其他内置的管理接口需要签名
+//
+//	shiba:
+//	  signature:
+//	    enable: true
+//	    scheme: md5
+//	    window: 5m
+//	    nonceStore: redis
+//	    redis: default
+//	    secrets:
+//	      app1: "NiD+6Ihdkwie40HxpZmw"
+
+// 签名方式
+const (
+	// SignatureSchemeMD5 表单jsonStr中的公共请求参数，authId、reqMethod、reqTime(20060102150405)、signature
+	// signature = MD5(authId + reqMethod + reqTime + MD5(reqMethod + reqTime + secret))
+	// 签名不包含nonce和请求内容，只校验时间窗口，不能防重放，兼容旧的客户端
+	SignatureSchemeMD5 = "md5"
+	// SignatureSchemeHMACSHA256 请求头X-Auth-Id、X-Timestamp(unix秒)、X-Nonce、X-Signature，nonce必填
+	// signature = hex(HMAC-SHA256(method + URL + body + timestamp + nonce, secret))，URL为请求的RequestURI
+	SignatureSchemeHMACSHA256 = "hmac-sha256"
+)
+
+// nonce存储
+const (
+	NonceStoreMemory = "memory"
+	NonceStoreRedis  = "redis"
+)
+
+// 签名请求头
+const (
+	SignatureAuthIDHeader    = "X-Auth-Id"
+	SignatureTimestampHeader = "X-Timestamp"
+	SignatureNonceHeader     = "X-Nonce"
+	SignatureHeader          = "X-Signature"
+)
+
+var (
+	ErrSignatureMissing  = errors.New("signature missing")
+	ErrSignatureAuthID   = errors.New("unknown authId")
+	ErrSignatureExpired  = errors.New("timestamp out of window")
+	ErrSignatureMismatch = errors.New("signature mismatch")
+	ErrSignatureReplay   = errors.New("request replayed")
+)
+
+type SignatureConfig struct {
+	Enable     bool              `yaml:"enable"`
+	SchemeName string            `yaml:"scheme"`     // md5 hmac-sha256，默认md5
+	Secrets    map[string]string `yaml:"secrets"`    // authId对应的密钥
+	Window     time.Duration     `yaml:"window"`     // 请求时间和服务器时间允许的误差，默认5m
+	NonceStore string            `yaml:"nonceStore"` // memory redis，默认memory，多实例部署需要使用redis
+	Redis      string            `yaml:"redis"`      // redis配置名，默认default
+	Exclude    []string          `yaml:"exclude"`    // 不校验的路径，以*结尾时按前缀匹配
+	MaxBody    int64             `yaml:"maxBody"`    // 读取请求体的最大字节数，默认10MB
+
+	Scheme  SignatureScheme                                         `yaml:"-"` // 自定义签名方式，优先于SchemeName
+	OnError func(w http.ResponseWriter, r *http.Request, err error) `yaml:"-"` // 校验失败的响应，默认返回401
+}
+
+// SignedRequest 请求中的签名参数
+type SignedRequest struct {
+	AuthID    string
+	Timestamp time.Time
+	Nonce     string // 防重放的唯一标识，在Window*2内只能使用一次，为空时不检查，需要防重放的签名方式应要求必填
+	Data      string // 参与签名的内容
+	Signature string
+}
+
+// SignatureScheme 签名方式，Parse读取签名参数，Sign使用密钥计算签名
+type SignatureScheme interface {
+	Parse(r *http.Request, body []byte) (*SignedRequest, error)
+	Sign(req *SignedRequest, secret string) string
+}
+
+type md5Scheme struct{}
+
+func (md5Scheme) Parse(r *http.Request, body []byte) (*SignedRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	jsonStr := r.PostFormValue("jsonStr")
+	if jsonStr == "" {
+		return nil, ErrSignatureMissing
+	}
+
+	var req struct {
+		Method  string `json:"reqMethod"`
+		AuthId  string `json:"authId"`
+		ReqTime string `json:"reqTime"`
+		Sign    string `json:"signature"`
+	}
+	if err := json.Unmarshal([]byte(jsonStr), &req); err != nil {
+		return nil, err
+	}
+
+	if req.Sign == "" {
+		return nil, ErrSignatureMissing
+	}
+
+	ts, err := time.ParseInLocation("20060102150405", req.ReqTime, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("reqTime:%w", err)
+	}
+
+	return &SignedRequest{
+		AuthID:    req.AuthId,
+		Timestamp: ts,
+		Data:      req.Method + req.ReqTime,
+		Signature: req.Sign,
+	}, nil
+}
+
+func (md5Scheme) Sign(req *SignedRequest, secret string) string {
+	return utils.MD5(req.AuthID + req.Data + utils.MD5(req.Data+secret))
+}
+
+type hmacSHA256Scheme struct{}
+
+func (hmacSHA256Scheme) Parse(r *http.Request, body []byte) (*SignedRequest, error) {
+	signature := r.Header.Get(SignatureHeader)
+	timestamp := r.Header.Get(SignatureTimestampHeader)
+	nonce := r.Header.Get(SignatureNonceHeader)
+	if signature == "" || timestamp == "" || nonce == "" {
+		return nil, ErrSignatureMissing
+	}
+
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("timestamp:%w", err)
+	}
+
+	return &SignedRequest{
+		AuthID:    r.Header.Get(SignatureAuthIDHeader),
+		Timestamp: time.Unix(sec, 0),
+		Nonce:     nonce,
+		Data:      r.Method + r.URL.RequestURI() + string(body) + timestamp + nonce,
+		Signature: signature,
+	}, nil
+}
+
+func (hmacSHA256Scheme) Sign(req *SignedRequest, secret string) string {
+	return utils.Sha256(req.Data, secret)
+}
+
+// NonceStore 记录已使用的nonce，首次使用返回true
+type NonceStore interface {
+	Use(ctx context.Context, key string, ttl time.Duration) (bool, error)
+}
+
+type redisNonceStore struct {
+	client RedisCmdable
+}
+
+func (s *redisNonceStore) Use(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, "shiba:nonce:"+key, 1, ttl).Result()
+}
+
+// memoryNonceStore 进程内nonce，写入时清理过期的记录
+type memoryNonceStore struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+func newMemoryNonceStore() *memoryNonceStore {
+	return &memoryNonceStore{nonces: make(map[string]time.Time)}
+}
+
+func (s *memoryNonceStore) Use(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > ttl {
+		for k, expiresAt := range s.nonces {
+			if now.After(expiresAt) {
+				delete(s.nonces, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if expiresAt, ok := s.nonces[key]; ok && now.Before(expiresAt) {
+		return false, nil
+	}
+
+	s.nonces[key] = now.Add(ttl)
+	return true, nil
+}
+
+type signatureAuthIDKey struct{}
+
+// SignatureAuthIDFromContext 返回签名校验通过的authId
+func SignatureAuthIDFromContext(ctx context.Context) string {
+	authID, _ := ctx.Value(signatureAuthIDKey{}).(string)
+	return authID
+}
+
+// MiddlewareSignature 校验请求签名、时间戳和nonce，校验通过后authId写入ctx
+// scheme、nonceStore不支持或redis配置不存在时返回错误
+func MiddlewareSignature(cfg SignatureConfig) (MiddlewareFunc, error) {
+	scheme := cfg.Scheme
+	if scheme == nil {
+		switch cfg.SchemeName {
+		case SignatureSchemeMD5, "":
+			scheme = md5Scheme{}
+		case SignatureSchemeHMACSHA256:
+			scheme = hmacSHA256Scheme{}
+		default:
+			return nil, errors.New("signature:unsupported scheme:" + cfg.SchemeName)
+		}
+	}
+
+	if cfg.Window <= 0 {
+		cfg.Window = 5 * time.Minute
+	}
+
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = 10 << 20
+	}
+
+	var store NonceStore
+	switch cfg.NonceStore {
+	case NonceStoreMemory, "":
+		store = newMemoryNonceStore()
+	case NonceStoreRedis:
+		name := cfg.Redis
+		if name == "" {
+			name = "default"
+		}
+
+		client, err := redisx.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("signature:nonce store:%w", err)
+		}
+		store = &redisNonceStore{client: client}
+	default:
+		return nil, errors.New("signature:unsupported nonce store:" + cfg.NonceStore)
+	}
+
+	onError := cfg.OnError
+	if onError == nil {
+		onError = func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, "signature check failed:"+err.Error(), http.StatusUnauthorized)
+		}
+	}
+
+	logger := defaultLogger.Clone("signature")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if matchPaths(cfg.Exclude, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			authID, err := verifySignature(r, scheme, cfg, store)
+			if err != nil {
+				logger.Warnf("%s %s authId:%s:%s", r.Method, r.URL.Path, authID, err.Error())
+				onError(w, r, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signatureAuthIDKey{}, authID)))
+		})
+	}, nil
+}
+
+func verifySignature(r *http.Request, scheme SignatureScheme, cfg SignatureConfig, store NonceStore) (string, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(http.MaxBytesReader(nil, r.Body, cfg.MaxBody))
+		r.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		// 后续handler可以再次读取
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	req, err := scheme.Parse(r, body)
+	// Parse可能读取了请求体(如ParseForm)，再次恢复
+	if body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	secret, ok := cfg.Secrets[req.AuthID]
+	if !ok {
+		return req.AuthID, ErrSignatureAuthID
+	}
+
+	if d := time.Since(req.Timestamp); d > cfg.Window || d < -cfg.Window {
+		return req.AuthID, ErrSignatureExpired
+	}
+
+	if !hmac.Equal([]byte(scheme.Sign(req, secret)), []byte(req.Signature)) {
+		return req.AuthID, ErrSignatureMismatch
+	}
+
+	// 签名通过后再记录nonce，避免伪造的请求占用nonce
+	if req.Nonce != "" {
+		ok, err := store.Use(r.Context(), req.AuthID+":"+req.Nonce, 2*cfg.Window)
+		if err != nil {
+			return req.AuthID, fmt.Errorf("nonce:%w", err)
+		}
+		if !ok {
+			return req.AuthID, ErrSignatureReplay
+		}
+	}
+
+	return req.AuthID, nil
+}
@@ -0,0 +1,145 @@
+package shiba
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/windzhu0514/shiba/utils"
+)
+
+func signatureHandler(t *testing.T, cfg SignatureConfig) http.Handler {
+	mw, err := MiddlewareSignature(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(SignatureAuthIDFromContext(r.Context()) + ":" + string(body)))
+	}))
+}
+
+func md5SignedRequest(authID, method, secret string, reqTime time.Time) *http.Request {
+	ts := reqTime.Format("20060102150405")
+	sign := utils.MD5(authID + method + ts + utils.MD5(method+ts+secret))
+	jsonStr := `{"authId":"` + authID + `","reqMethod":"` + method + `","reqTime":"` + ts + `","signature":"` + sign + `"}`
+
+	r := httptest.NewRequest(http.MethodPost, "/api", strings.NewReader(url.Values{"jsonStr": {jsonStr}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestMiddlewareSignatureMD5(t *testing.T) {
+	h := signatureHandler(t, SignatureConfig{
+		Secrets: map[string]string{"app1": "secret"},
+		Exclude: []string{"/health"},
+	})
+
+	cases := []struct {
+		name string
+		req  *http.Request
+		code int
+	}{
+		{"ok", md5SignedRequest("app1", "order.create", "secret", time.Now()), http.StatusOK},
+		{"mismatch", md5SignedRequest("app1", "order.create", "wrong", time.Now()), http.StatusUnauthorized},
+		{"unknown authId", md5SignedRequest("app2", "order.create", "secret", time.Now()), http.StatusUnauthorized},
+		{"expired", md5SignedRequest("app1", "order.create", "secret", time.Now().Add(-time.Hour)), http.StatusUnauthorized},
+		{"missing", httptest.NewRequest(http.MethodPost, "/api", nil), http.StatusUnauthorized},
+		{"exclude", httptest.NewRequest(http.MethodGet, "/health", nil), http.StatusOK},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, c.req)
+		if w.Code != c.code {
+			t.Errorf("%s: code %d want %d, body:%s", c.name, w.Code, c.code, w.Body.String())
+		}
+	}
+
+	// 校验后handler仍能读取原始请求体
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, md5SignedRequest("app1", "order.create", "secret", time.Now()))
+	if !strings.HasPrefix(w.Body.String(), "app1:jsonStr=") {
+		t.Fatalf("body %s", w.Body.String())
+	}
+
+	// md5不防重放，同一秒内相同reqMethod的请求都能通过
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, md5SignedRequest("app1", "order.query", "secret", now))
+		if w.Code != http.StatusOK {
+			t.Errorf("request %d: code %d", i, w.Code)
+		}
+	}
+}
+
+func TestMiddlewareSignatureConfig(t *testing.T) {
+	for _, cfg := range []SignatureConfig{
+		{SchemeName: "sha1"},
+		{NonceStore: "etcd"},
+		{NonceStore: NonceStoreRedis, Redis: "missing"},
+	} {
+		if _, err := MiddlewareSignature(cfg); err == nil {
+			t.Errorf("%+v: expected error", cfg)
+		}
+	}
+}
+
+func TestMiddlewareSignatureHMACSHA256(t *testing.T) {
+	newTestRedis(t, "default")
+
+	h := signatureHandler(t, SignatureConfig{
+		SchemeName: SignatureSchemeHMACSHA256,
+		Secrets:    map[string]string{"app1": "secret"},
+		NonceStore: NonceStoreRedis,
+	})
+
+	newRequest := func(method, nonce, secret string) *http.Request {
+		body := `{"id":1}`
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		r := httptest.NewRequest(method, "/api?a=1", strings.NewReader(body))
+		r.Header.Set(SignatureAuthIDHeader, "app1")
+		r.Header.Set(SignatureTimestampHeader, ts)
+		r.Header.Set(SignatureNonceHeader, nonce)
+		r.Header.Set(SignatureHeader, utils.Sha256(http.MethodPost+"/api?a=1"+body+ts+nonce, secret))
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(http.MethodPost, "n1", "secret"))
+	if w.Code != http.StatusOK || w.Body.String() != `app1:{"id":1}` {
+		t.Fatalf("code %d body %s", w.Code, w.Body.String())
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		nonce  string
+		key    string
+	}{
+		{"replay", http.MethodPost, "n1", "secret"},
+		{"mismatch", http.MethodPost, "n2", "wrong"},
+		{"method", http.MethodPut, "n2", "secret"},
+		{"missing nonce", http.MethodPost, "", "secret"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newRequest(c.method, c.nonce, c.key))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: code %d", c.name, w.Code)
+		}
+	}
+
+	// 签名错误的请求不占用nonce
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newRequest(http.MethodPost, "n2", "secret"))
+	if w.Code != http.StatusOK {
+		t.Errorf("nonce n2: code %d body %s", w.Code, w.Body.String())
+	}
+}
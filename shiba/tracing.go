@@ -0,0 +1,438 @@
+package shiba
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+	"github.com/uber/jaeger-client-go/config"
+	jaegerprop "go.opentelemetry.io/contrib/propagators/jaeger"
+	"go.opentelemetry.io/contrib/samplers/jaegerremote"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otbridge "go.opentelemetry.io/otel/bridge/opentracing"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// 链路追踪
+// 代码中统一使用opentracing接口，exporter为jaeger时使用jaeger客户端上报到agent，
+// 为otlphttp、otlpgrpc时通过OpenTelemetry桥接上报到collector
+//
+//	shiba:
+//	  tracing:
+//	    exporter: otlpgrpc
+//	    endpoint: localhost:4317
+//	    insecure: true
+//	    sampler:
+//	      type: probabilistic
+//	      param: 0.1
+//	    propagation: [w3c, jaeger]
+//	    attributes:
+//	      env: prod
+
+// 上报方式
+const (
+	TracingExporterJaeger   = "jaeger"
+	TracingExporterOTLPHTTP = "otlphttp"
+	TracingExporterOTLPGRPC = "otlpgrpc"
+)
+
+// 采样方式，和jaeger客户端一致
+const (
+	TracingSamplerConst         = "const"
+	TracingSamplerProbabilistic = "probabilistic"
+	TracingSamplerRateLimiting  = "ratelimiting"
+	TracingSamplerRemote        = "remote"
+)
+
+// 跨服务传递的请求头
+const (
+	TracingPropagationW3C    = "w3c"    // traceparent tracestate
+	TracingPropagationJaeger = "jaeger" // uber-trace-id
+)
+
+const w3cTraceparentHeader = "traceparent"
+
+type TracingConfig struct {
+	Exporter    string               `yaml:"exporter"` // jaeger otlphttp otlpgrpc，为空时不开启
+	Endpoint    string               `yaml:"endpoint"` // jaeger为agent地址，默认localhost:6831，otlp为collector地址，默认localhost:4318/localhost:4317
+	Insecure    bool                 `yaml:"insecure"` // otlp不使用tls
+	Sampler     TracingSamplerConfig `yaml:"sampler"`
+	Propagation []string             `yaml:"propagation"` // w3c jaeger，默认都开启，注入时都写入，提取时按顺序
+	Attributes  map[string]string    `yaml:"attributes"`  // 附加到所有span的资源属性
+}
+
+type TracingSamplerConfig struct {
+	Type string `yaml:"type"` // const probabilistic ratelimiting remote，默认const
+	// const为1全部采样，0不采样；probabilistic为采样概率；ratelimiting为每秒采样数；remote为获取策略前的采样概率
+	Param             float64       `yaml:"param"`
+	SamplingServerURL string        `yaml:"samplingServerURL"` // remote采样策略地址，默认http://localhost:5778/sampling
+	RefreshInterval   time.Duration `yaml:"refreshInterval"`   // remote采样策略刷新间隔，默认1m
+}
+
+func (cfg *TracingConfig) propagation() ([]string, error) {
+	if len(cfg.Propagation) == 0 {
+		return []string{TracingPropagationW3C, TracingPropagationJaeger}, nil
+	}
+
+	for _, p := range cfg.Propagation {
+		if p != TracingPropagationW3C && p != TracingPropagationJaeger {
+			return nil, errors.New("unsupported propagation:" + p)
+		}
+	}
+
+	return cfg.Propagation, nil
+}
+
+// newTracer 按配置创建tracer并设置为opentracing的全局tracer
+func newTracer(serviceName string, cfg TracingConfig) (io.Closer, error) {
+	switch cfg.Exporter {
+	case TracingExporterJaeger:
+		return newJaegerTracer(serviceName, cfg)
+	case TracingExporterOTLPHTTP, TracingExporterOTLPGRPC:
+		return newOTelTracer(serviceName, cfg)
+	}
+
+	return nil, errors.New("unsupported exporter:" + cfg.Exporter)
+}
+
+func newJaegerTracer(serviceName string, cfg TracingConfig) (io.Closer, error) {
+	propagation, err := cfg.propagation()
+	if err != nil {
+		return nil, err
+	}
+
+	samplerType := cfg.Sampler.Type
+	if samplerType == "" {
+		samplerType = TracingSamplerConst
+	}
+	samplerParam := cfg.Sampler.Param
+	if cfg.Sampler.Type == "" && samplerParam == 0 {
+		samplerParam = 1
+	}
+
+	jcfg := &config.Configuration{
+		ServiceName: serviceName,
+		Sampler: &config.SamplerConfig{
+			Type:                    samplerType,
+			Param:                   samplerParam,
+			SamplingServerURL:       cfg.Sampler.SamplingServerURL,
+			SamplingRefreshInterval: cfg.Sampler.RefreshInterval,
+		},
+		Reporter: &config.ReporterConfig{
+			BufferFlushInterval: 1 * time.Second,
+			LocalAgentHostPort:  cfg.Endpoint,
+		},
+	}
+	for k, v := range cfg.Attributes {
+		jcfg.Tags = append(jcfg.Tags, opentracing.Tag{Key: k, Value: v})
+	}
+
+	propagator := &jaegerPropagator{propagation: propagation}
+	propagator.uber = jaeger.NewHTTPHeaderPropagator((&jaeger.HeadersConfig{}).ApplyDefaults(), *jaeger.NewNullMetrics())
+	tracer, closer, err := jcfg.NewTracer(
+		config.Injector(opentracing.HTTPHeaders, propagator),
+		config.Extractor(opentracing.HTTPHeaders, propagator),
+		config.Injector(opentracing.TextMap, propagator),
+		config.Extractor(opentracing.TextMap, propagator),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	opentracing.SetGlobalTracer(tracer)
+	return closer, nil
+}
+
+// jaegerPropagator jaeger客户端同时支持uber-trace-id和W3C traceparent
+type jaegerPropagator struct {
+	propagation []string
+	uber        *jaeger.TextMapPropagator
+}
+
+func (p *jaegerPropagator) Inject(sc jaeger.SpanContext, carrier interface{}) error {
+	writer, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+
+	for _, name := range p.propagation {
+		switch name {
+		case TracingPropagationJaeger:
+			if err := p.uber.Inject(sc, carrier); err != nil {
+				return err
+			}
+		case TracingPropagationW3C:
+			flags := "00"
+			if sc.IsSampled() {
+				flags = "01"
+			}
+			writer.Set(w3cTraceparentHeader, fmt.Sprintf("00-%016x%016x-%016x-%s",
+				sc.TraceID().High, sc.TraceID().Low, uint64(sc.SpanID()), flags))
+		}
+	}
+
+	return nil
+}
+
+func (p *jaegerPropagator) Extract(carrier interface{}) (jaeger.SpanContext, error) {
+	reader, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return jaeger.SpanContext{}, opentracing.ErrInvalidCarrier
+	}
+
+	for _, name := range p.propagation {
+		switch name {
+		case TracingPropagationJaeger:
+			sc, err := p.uber.Extract(carrier)
+			if err == nil {
+				return sc, nil
+			}
+			if err != opentracing.ErrSpanContextNotFound {
+				return sc, err
+			}
+		case TracingPropagationW3C:
+			var traceparent string
+			reader.ForeachKey(func(key, val string) error {
+				if strings.ToLower(key) == w3cTraceparentHeader {
+					traceparent = val
+				}
+				return nil
+			})
+			if traceparent == "" {
+				continue
+			}
+
+			return parseTraceparent(traceparent)
+		}
+	}
+
+	return jaeger.SpanContext{}, opentracing.ErrSpanContextNotFound
+}
+
+// parseTraceparent 解析 version-traceid-parentid-flags
+func parseTraceparent(s string) (jaeger.SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+
+	traceID, err := jaeger.TraceIDFromString(parts[1])
+	if err != nil || !traceID.IsValid() {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+
+	spanID, err := jaeger.SpanIDFromString(parts[2])
+	if err != nil || spanID == 0 {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextCorrupted
+	}
+
+	return jaeger.NewSpanContext(traceID, spanID, 0, flags[0]&1 == 1, nil), nil
+}
+
+func newOTelTracer(serviceName string, cfg TracingConfig) (io.Closer, error) {
+	names, err := cfg.propagation()
+	if err != nil {
+		return nil, err
+	}
+
+	var propagators []propagation.TextMapPropagator
+	for _, name := range names {
+		switch name {
+		case TracingPropagationW3C:
+			propagators = append(propagators, propagation.TraceContext{}, propagation.Baggage{})
+		case TracingPropagationJaeger:
+			propagators = append(propagators, jaegerprop.Jaeger{})
+		}
+	}
+	propagator := propagation.NewCompositeTextMapPropagator(propagators...)
+
+	sampler, remote, err := newOTelSampler(serviceName, cfg.Sampler)
+	if err != nil {
+		return nil, err
+	}
+	// 远程采样器后台定时拉取采样策略，ParentBased包装后没有Close，需要单独关闭
+	closeRemote := func() {
+		if remote != nil {
+			remote.Close()
+		}
+	}
+
+	attrs := []attribute.KeyValue{semconv.ServiceName(serviceName)}
+	for k, v := range cfg.Attributes {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, attrs...))
+	if err != nil {
+		closeRemote()
+		return nil, err
+	}
+
+	exporter, err := newOTLPExporter(cfg)
+	if err != nil {
+		closeRemote()
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sampler),
+	)
+
+	bridge, wrapper := otbridge.NewTracerPair(tp.Tracer("github.com/windzhu0514/shiba"))
+	bridge.SetTextMapPropagator(propagator)
+	bridge.SetWarningHandler(func(msg string) {
+		defaultLogger.Clone("tracing").Warn(strings.TrimSpace(msg))
+	})
+
+	opentracing.SetGlobalTracer(bridge)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		defaultLogger.Clone("tracing").Error(err.Error())
+	}))
+	otel.SetTracerProvider(wrapper)
+	otel.SetTextMapPropagator(propagator)
+
+	return closerFunc(func() error {
+		closeRemote()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return tp.Shutdown(ctx)
+	}), nil
+}
+
+func newOTLPExporter(cfg TracingConfig) (*otlptrace.Exporter, error) {
+	ctx := context.Background()
+	if cfg.Exporter == TracingExporterOTLPHTTP {
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+
+	var opts []otlptracegrpc.Option
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+// newOTelSampler 采样配置和jaeger客户端一致，有上游时跟随上游的采样结果
+// remote类型同时返回远程采样器，关闭tracer时需要调用它的Close停止拉取采样策略
+func newOTelSampler(serviceName string, cfg TracingSamplerConfig) (sdktrace.Sampler, *jaegerremote.Sampler, error) {
+	switch cfg.Type {
+	case TracingSamplerConst, "":
+		if cfg.Type == "" || cfg.Param != 0 {
+			return sdktrace.ParentBased(sdktrace.AlwaysSample()), nil, nil
+		}
+		return sdktrace.ParentBased(sdktrace.NeverSample()), nil, nil
+	case TracingSamplerProbabilistic:
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Param)), nil, nil
+	case TracingSamplerRateLimiting:
+		return sdktrace.ParentBased(newRateLimitingSampler(cfg.Param)), nil, nil
+	case TracingSamplerRemote:
+		opts := []jaegerremote.Option{
+			jaegerremote.WithInitialSampler(sdktrace.TraceIDRatioBased(cfg.Param)),
+		}
+		if cfg.SamplingServerURL != "" {
+			opts = append(opts, jaegerremote.WithSamplingServerURL(cfg.SamplingServerURL))
+		}
+		if cfg.RefreshInterval > 0 {
+			opts = append(opts, jaegerremote.WithSamplingRefreshInterval(cfg.RefreshInterval))
+		}
+		remote := jaegerremote.New(serviceName, opts...)
+		return sdktrace.ParentBased(remote), remote, nil
+	}
+
+	return nil, nil, errors.New("unsupported sampler:" + cfg.Type)
+}
+
+// rateLimitingSampler 每秒最多采样perSecond个trace
+type rateLimitingSampler struct {
+	mu         sync.Mutex
+	perSecond  float64
+	maxBalance float64 // 和jaeger一样至少为1，perSecond小于1时也能采样
+	tokens     float64
+	last       time.Time
+}
+
+func newRateLimitingSampler(perSecond float64) *rateLimitingSampler {
+	maxBalance := math.Max(perSecond, 1)
+	return &rateLimitingSampler{perSecond: perSecond, maxBalance: maxBalance, tokens: maxBalance, last: time.Now()}
+}
+
+func (s *rateLimitingSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	s.mu.Lock()
+	now := time.Now()
+	s.tokens += now.Sub(s.last).Seconds() * s.perSecond
+	if s.tokens > s.maxBalance {
+		s.tokens = s.maxBalance
+	}
+	s.last = now
+
+	decision := sdktrace.Drop
+	if s.tokens >= 1 {
+		s.tokens--
+		decision = sdktrace.RecordAndSample
+	}
+	s.mu.Unlock()
+
+	return sdktrace.SamplingResult{
+		Decision:   decision,
+		Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+	}
+}
+
+func (s *rateLimitingSampler) Description() string {
+	return fmt.Sprintf("RateLimitingSampler{%g}", s.perSecond)
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// spanContextIDs 返回span的traceID和spanID，不支持的tracer返回空
+func spanContextIDs(sc opentracing.SpanContext) (traceID, spanID string) {
+	switch c := sc.(type) {
+	case jaeger.SpanContext:
+		return c.TraceID().String(), c.SpanID().String()
+	case interface {
+		TraceID() trace.TraceID
+		SpanID() trace.SpanID
+	}:
+		return c.TraceID().String(), c.SpanID().String()
+	}
+
+	return "", ""
+}
@@ -0,0 +1,152 @@
+package shiba
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingPropagation(t *testing.T) {
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	for _, exporter := range []string{TracingExporterJaeger, TracingExporterOTLPHTTP} {
+		t.Run(exporter, func(t *testing.T) {
+			closer, err := newTracer("test", TracingConfig{
+				Exporter: exporter,
+				Endpoint: "127.0.0.1:1",
+				Insecure: true,
+				Sampler:  TracingSamplerConfig{Type: TracingSamplerRateLimiting, Param: 100},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+
+			tracer := opentracing.GlobalTracer()
+			span := tracer.StartSpan("test")
+			defer span.Finish()
+			traceID, spanID := spanContextIDs(span.Context())
+			if traceID == "" || spanID == "" {
+				t.Fatal("empty span ids")
+			}
+
+			header := http.Header{}
+			if err := tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header)); err != nil {
+				t.Fatal(err)
+			}
+			if header.Get("traceparent") == "" || header.Get("uber-trace-id") == "" {
+				t.Fatalf("header %v", header)
+			}
+
+			// 只有traceparent时也能提取
+			w3c := http.Header{"Traceparent": {header.Get("traceparent")}}
+			sc, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(w3c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			child := tracer.StartSpan("child", opentracing.ChildOf(sc))
+			defer child.Finish()
+			if childTraceID, _ := spanContextIDs(child.Context()); childTraceID != traceID {
+				t.Fatalf("trace id %s != %s", childTraceID, traceID)
+			}
+		})
+	}
+
+	if _, err := newTracer("test", TracingConfig{Exporter: TracingExporterJaeger, Propagation: []string{"b3"}}); err == nil {
+		t.Fatal("expect unsupported propagation error")
+	}
+}
+
+func TestRateLimitingSampler(t *testing.T) {
+	s := newRateLimitingSampler(0.5)
+	sample := func() bool {
+		return s.ShouldSample(sdktrace.SamplingParameters{}).Decision == sdktrace.RecordAndSample
+	}
+
+	if !sample() {
+		t.Fatal("first trace not sampled")
+	}
+	if sample() {
+		t.Fatal("second trace sampled within the same second")
+	}
+
+	// 每秒0.5个，2秒后再采样一个
+	s.mu.Lock()
+	s.last = s.last.Add(-2 * time.Second)
+	s.mu.Unlock()
+	if !sample() {
+		t.Fatal("trace not sampled after 2s")
+	}
+}
+
+func TestRemoteSamplerFollowsParent(t *testing.T) {
+	// 初始采样率为0，有已采样的上游时仍然采样
+	sampler, remote, err := newOTelSampler("test", TracingSamplerConfig{
+		Type:              TracingSamplerRemote,
+		SamplingServerURL: "http://127.0.0.1:1/sampling",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	result := sampler.ShouldSample(sdktrace.SamplingParameters{
+		ParentContext: trace.ContextWithRemoteSpanContext(context.Background(), parent),
+		TraceID:       parent.TraceID(),
+	})
+	if result.Decision != sdktrace.RecordAndSample {
+		t.Fatalf("decision %v", result.Decision)
+	}
+}
+
+func TestRemoteSamplerClose(t *testing.T) {
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	var polls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&polls, 1)
+		w.Write([]byte(`{"strategyType":"PROBABILISTIC","probabilisticSampling":{"samplingRate":1}}`))
+	}))
+	defer srv.Close()
+
+	closer, err := newTracer("test", TracingConfig{
+		Exporter: TracingExporterOTLPHTTP,
+		Endpoint: "127.0.0.1:1",
+		Insecure: true,
+		Sampler: TracingSamplerConfig{
+			Type:              TracingSamplerRemote,
+			SamplingServerURL: srv.URL,
+			RefreshInterval:   10 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100 && atomic.LoadInt32(&polls) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&polls) == 0 {
+		t.Fatal("remote sampler not polling")
+	}
+
+	closer.Close()
+	n := atomic.LoadInt32(&polls)
+	time.Sleep(100 * time.Millisecond)
+	if got := atomic.LoadInt32(&polls); got != n {
+		t.Fatalf("remote sampler still polling after close, %d -> %d", n, got)
+	}
+}
@@ -1,33 +1,25 @@
 package shiba
 
 import (
+	"math/rand"
 	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/robfig/cron/v3"
 )
 
 // 获取结构体db tag的值列表
+// 展开嵌入结构体，忽略tag中的选项（pk、omitempty）
 func DBFields(rv reflect.Value) []string {
 	if rv.Kind() == reflect.Ptr {
 		rv = rv.Elem()
 	}
 
-	rt := rv.Type()
-
 	var fields []string
 	if rv.Kind() == reflect.Struct {
-		for i := 0; i < rv.NumField(); i++ {
-			sf := rv.Field(i)
-			if sf.Kind() == reflect.Struct {
-				fields = append(fields, DBFields(sf)...)
-				continue
-			}
-
-			tagName := rt.Field(i).Tag.Get("db")
-			if tagName != "" {
-				fields = append(fields, tagName)
-			}
+		for _, f := range structDBFields(rv.Type()) {
+			fields = append(fields, f.name)
 		}
 		return fields
 	}
@@ -42,7 +34,7 @@ func DBFields(rv reflect.Value) []string {
 	return nil
 }
 
-// ImmediateSchedule 加入cron任务后立即运行
+// ImmediateSchedule 加入cron任务后立即运行，之后按schedule运行
 // https://github.com/robfig/cron
 type ImmediateSchedule struct {
 	first    int32
@@ -50,22 +42,71 @@ type ImmediateSchedule struct {
 }
 
 func NewImmediateSchedule(spec string) (*ImmediateSchedule, error) {
-	parser := cron.NewParser(
-		cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
-	)
-	schedule, err := parser.Parse(spec)
+	schedule, err := cronParser.Parse(spec)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ImmediateSchedule{schedule: schedule}, nil
+	return Immediate(schedule), nil
+}
+
+// Immediate 包装schedule，可以和JitterSchedule、LocationSchedule组合使用
+func Immediate(schedule cron.Schedule) *ImmediateSchedule {
+	return &ImmediateSchedule{schedule: schedule}
 }
 
+// Next 首次调用返回t，分布式任务会在其他goroutine中调用Next，需要并发安全
 func (schedule *ImmediateSchedule) Next(t time.Time) time.Time {
-	if schedule.first == 0 {
-		schedule.first = 1
+	if atomic.CompareAndSwapInt32(&schedule.first, 0, 1) {
 		return t
 	}
 
 	return schedule.schedule.Next(t)
 }
+
+// JitterSchedule 在schedule的执行时间后随机延迟[0, jitter)，避免多个实例同时执行
+type JitterSchedule struct {
+	schedule cron.Schedule
+	jitter   time.Duration
+}
+
+func Jitter(schedule cron.Schedule, jitter time.Duration) *JitterSchedule {
+	return &JitterSchedule{schedule: schedule, jitter: jitter}
+}
+
+func (schedule *JitterSchedule) Next(t time.Time) time.Time {
+	next := schedule.schedule.Next(t)
+	if next.IsZero() || schedule.jitter <= 0 {
+		return next
+	}
+
+	return next.Add(time.Duration(rand.Int63n(int64(schedule.jitter))))
+}
+
+// LocationSchedule 在loc时区计算schedule的执行时间，spec中的CRON_TZ优先
+type LocationSchedule struct {
+	schedule cron.Schedule
+	loc      *time.Location
+}
+
+func InLocation(schedule cron.Schedule, loc *time.Location) *LocationSchedule {
+	return &LocationSchedule{schedule: schedule, loc: loc}
+}
+
+func (schedule *LocationSchedule) Next(t time.Time) time.Time {
+	return schedule.schedule.Next(t.In(schedule.loc))
+}
+
+// baseSchedule 去掉ImmediateSchedule和JitterSchedule，返回不含随机延迟的schedule
+func baseSchedule(schedule cron.Schedule) cron.Schedule {
+	for {
+		switch s := schedule.(type) {
+		case *ImmediateSchedule:
+			schedule = s.schedule
+		case *JitterSchedule:
+			schedule = s.schedule
+		default:
+			return schedule
+		}
+	}
+}
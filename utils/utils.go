@@ -94,10 +94,9 @@ func StructDBFields(values interface{}) []string {
 	fields := []string{}
 	if v.Kind() == reflect.Struct {
 		for i := 0; i < v.NumField(); i++ {
-			f := v.Type().Field(i)
-			_ = f
-			field := v.Type().Field(i).Tag.Get("db")
-			if field != "" {
+			// 忽略tag中的选项，如db:"id,pk"
+			field := strings.Split(v.Type().Field(i).Tag.Get("db"), ",")[0]
+			if field != "" && field != "-" {
 				fields = append(fields, field)
 			}
 		}